@@ -12,17 +12,17 @@ func newAttrModule() *starlarkstruct.Module {
 	return &starlarkstruct.Module{
 		Name: "attr",
 		Members: starlark.StringDict{
-			"bool":     starlark.NewBuiltin("attr.bool", attrBool),
-			"int":      starlark.NewBuiltin("attr.int", attrInt),
-			"int_list": starlark.NewBuiltin("attr.int_list", attrIntList),
-			"label":    starlark.NewBuiltin("attr.label", attrLabel),
-			//TODO:"label_keyed_string_dict": starlark.NewBuiltin("attr.label_keyed_string_dict", attrLabelKeyedStringDict),
-			"label_list":  starlark.NewBuiltin("attr.label_list", attrLabelList),
-			"output":      starlark.NewBuiltin("attr.output", attrOutput),
-			"output_list": starlark.NewBuiltin("attr.output_list", attrOutputList),
-			"string":      starlark.NewBuiltin("attr.string", attrString),
-			//TODO:"string_dict":             starlark.NewBuiltin("attr.string_dict", attrStringDict),
-			"string_list": starlark.NewBuiltin("attr.string_list", attrStringList),
+			"bool":                    starlark.NewBuiltin("attr.bool", attrBool),
+			"int":                     starlark.NewBuiltin("attr.int", attrInt),
+			"int_list":                starlark.NewBuiltin("attr.int_list", attrIntList),
+			"label":                   starlark.NewBuiltin("attr.label", attrLabel),
+			"label_keyed_string_dict": starlark.NewBuiltin("attr.label_keyed_string_dict", attrLabelKeyedStringDict),
+			"label_list":              starlark.NewBuiltin("attr.label_list", attrLabelList),
+			"output":                  starlark.NewBuiltin("attr.output", attrOutput),
+			"output_list":             starlark.NewBuiltin("attr.output_list", attrOutputList),
+			"string":                  starlark.NewBuiltin("attr.string", attrString),
+			"string_dict":             starlark.NewBuiltin("attr.string_dict", attrStringDict),
+			"string_list":             starlark.NewBuiltin("attr.string_list", attrStringList),
 			//TODO:"string_list_dict":        starlark.NewBuiltin("attr.string_list_dict", attrStringListDict),
 		},
 	}
@@ -170,6 +170,9 @@ func attrIntList(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tup
 	); err != nil {
 		return nil, err
 	}
+	if def == nil {
+		def = starlark.NewList(nil)
+	}
 
 	iter := def.Iterate()
 	var x starlark.Value
@@ -255,6 +258,49 @@ func attrLabel(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple
 	}, nil
 }
 
+// Attribute attr.label_keyed_string_dict(allow_empty=True, *, default={}, doc='', allow_files=None, mandatory=False)
+func attrLabelKeyedStringDict(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		def        *starlark.Dict
+		doc        string
+		mandatory  bool
+		allowEmpty bool = true
+		allowFiles starlark.Value
+	)
+	if err := starlark.UnpackArgs(
+		"attr.label_keyed_string_dict", args, kwargs,
+		"default?", &def, "doc?", &doc, "mandatory?", &mandatory, "allow_empty?", &allowEmpty, "allow_files?", &allowFiles,
+	); err != nil {
+		return nil, err
+	}
+	if def == nil {
+		def = starlark.NewDict(0)
+	}
+
+	// Check default labels and values are all strings
+	for _, item := range def.Items() {
+		for _, x := range item {
+			if _, ok := starlark.AsString(x); !ok {
+				return nil, fmt.Errorf("got %s, want string", x.Type())
+			}
+		}
+	}
+
+	af, err := parseAllowFiles(allowFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return &attr{
+		typ:        attrTypeLabelKeyedStringDict,
+		def:        def,
+		doc:        doc,
+		mandatory:  mandatory,
+		allowEmpty: allowEmpty,
+		allowFiles: af,
+	}, nil
+}
+
 // attr.label_list(allow_empty=True, *, default=[], doc='', allow_files=None, providers=[], flags=[], mandatory=False, cfg=None, aspects=[])
 func attrLabelList(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
@@ -270,6 +316,9 @@ func attrLabelList(thread *starlark.Thread, b *starlark.Builtin, args starlark.T
 	); err != nil {
 		return nil, err
 	}
+	if def == nil {
+		def = starlark.NewList(nil)
+	}
 
 	// TODO: default checks?
 	if def != nil {
@@ -392,6 +441,9 @@ func attrStringList(thread *starlark.Thread, b *starlark.Builtin, args starlark.
 	); err != nil {
 		return nil, err
 	}
+	if def == nil {
+		def = starlark.NewList(nil)
+	}
 
 	// Check defaults are all strings
 	if def != nil {
@@ -412,3 +464,39 @@ func attrStringList(thread *starlark.Thread, b *starlark.Builtin, args starlark.
 		mandatory: mandatory,
 	}, nil
 }
+
+// Attribute attr.string_dict(allow_empty=True, *, default={}, doc='', mandatory=False)
+func attrStringDict(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		def        *starlark.Dict
+		doc        string
+		mandatory  bool
+		allowEmpty bool = true
+	)
+	if err := starlark.UnpackArgs(
+		"attr.string_dict", args, kwargs,
+		"default?", &def, "doc?", &doc, "mandatory?", &mandatory, "allow_empty?", &allowEmpty,
+	); err != nil {
+		return nil, err
+	}
+	if def == nil {
+		def = starlark.NewDict(0)
+	}
+
+	// Check defaults are all strings
+	for _, item := range def.Items() {
+		for _, x := range item {
+			if _, ok := starlark.AsString(x); !ok {
+				return nil, fmt.Errorf("got %s, want string", x.Type())
+			}
+		}
+	}
+
+	return &attr{
+		typ:        attrTypeStringDict,
+		def:        def,
+		doc:        doc,
+		mandatory:  mandatory,
+		allowEmpty: allowEmpty,
+	}, nil
+}
@@ -1,5 +1,294 @@
 package laze
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
 // TODO: cache
 // https://github.com/golang/go/blob/master/src/cmd/go/internal/cache/cache.go
 // https://pkg.go.dev/github.com/rogpeppe/go-internal@v1.8.0/lockedfile
+
+// actionRecord describes the inputs of an action. Records of successful
+// actions are saved to the cache dir and compared on the next build to
+// explain why an action is or is not up to date.
+type actionRecord struct {
+	ID    string            `json:"id"`
+	Kind  string            `json:"kind"`
+	Hash  string            `json:"hash,omitempty"`  // file contents or rule source
+	Attrs map[string]string `json:"attrs,omitempty"` // attr name -> value
+	Deps  map[string]string `json:"deps,omitempty"`  // dep label -> id
+
+	// Inputs are the files read on execution, like the sources of a Go
+	// package. They're found by running the action, so the inputs of the
+	// previous record are hashed before the action runs again.
+	Inputs map[string]string `json:"inputs,omitempty"` // file -> hash
+}
+
+func hashFile(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if fi.IsDir() {
+		// Directories are hashed by listing.
+		names, err := f.Readdirnames(-1)
+		if err != nil {
+			return "", err
+		}
+		sort.Strings(names)
+		io.WriteString(h, strings.Join(names, "\n"))
+	} else if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// newActionRecord hashes the inputs of the action. Deps must already have
+// records. The stableStatusFile input is the hash of the stable status,
+// not read from the file as unstamped builds don't write it.
+func newActionRecord(a *Action, inputs []string, stableStatus string) (*actionRecord, error) {
+	rec := &actionRecord{Kind: a.kind()}
+
+	if a.rule == nil {
+		hash, err := hashFile(a.Key)
+		if err != nil {
+			return nil, err
+		}
+		rec.Hash = hash
+	} else {
+		// Changes to the rule implementation invalidate the action.
+		hash, err := hashFile(a.rule.impl.Position().Filename())
+		if err != nil {
+			return nil, err
+		}
+		rec.Hash = hash
+
+		rec.Attrs = make(map[string]string, len(a.args))
+		for name, v := range a.args {
+			s, ok := starlark.AsString(v)
+			if !ok {
+				s = v.String()
+			}
+			rec.Attrs[name] = s
+		}
+	}
+
+	if len(a.Deps) > 0 {
+		rec.Deps = make(map[string]string, len(a.Deps))
+		for _, a1 := range a.Deps {
+			if a1.rec == nil {
+				return nil, fmt.Errorf("missing record: %s", a1.Label)
+			}
+			rec.Deps[a1.Label] = a1.rec.ID
+		}
+	}
+
+	if len(inputs) > 0 {
+		rec.Inputs = make(map[string]string, len(inputs))
+		for _, name := range inputs {
+			if name == stableStatusFile {
+				rec.Inputs[name] = stableStatus
+				continue
+			}
+			hash, err := hashFile(name)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			rec.Inputs[name] = hash // empty if removed
+		}
+	}
+
+	// ID is the hash of the record.
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(b)
+	rec.ID = hex.EncodeToString(h[:])
+	return rec, nil
+}
+
+// recordActions creates records for the actions in dependency order. The
+// inputs of executed actions are the files they read, and the stable status
+// if stamped, otherwise the inputs of their cached record.
+func (b *Builder) recordActions(all []*Action, executed bool) error {
+	for _, a := range all {
+		inputs := a.inputs
+		if !executed {
+			old, err := b.loadRecord(a)
+			if err != nil {
+				return fmt.Errorf("%s: %w", a.Label, err)
+			}
+			inputs = old.inputNames()
+		} else if a.stamped {
+			inputs = append(append([]string(nil), inputs...), stableStatusFile)
+		}
+		rec, err := newActionRecord(a, inputs, b.stableStatusHash())
+		if err != nil {
+			return fmt.Errorf("%s: %w", a.Label, err)
+		}
+		a.rec = rec
+	}
+	return nil
+}
+
+// inputNames returns the sorted input files of the record.
+func (r *actionRecord) inputNames() []string {
+	if r == nil {
+		return nil
+	}
+	names := make([]string, 0, len(r.Inputs))
+	for name := range r.Inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// recordPath is the location of the cached record for the action.
+func (b *Builder) recordPath(a *Action) (string, error) {
+	dir, err := filepath.Abs(b.Dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(dir + "\x00" + a.Label))
+	return filepath.Join(b.CacheDir, "actions", hex.EncodeToString(h[:])+".json"), nil
+}
+
+// loadRecord returns the cached record, nil if missing.
+func (b *Builder) loadRecord(a *Action) (*actionRecord, error) {
+	if b.CacheDir == "" {
+		return nil, nil
+	}
+	name, err := b.recordPath(a)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var rec actionRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+// saveRecord writes the record of the action to the cache.
+func (b *Builder) saveRecord(a *Action) error {
+	if b.CacheDir == "" || a.rec == nil {
+		return nil
+	}
+	name, err := b.recordPath(a)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	data, err := json.Marshal(a.rec)
+	if err != nil {
+		return err
+	}
+
+	// Write atomically, builds may run concurrently.
+	f, err := os.CreateTemp(filepath.Dir(name), "record")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// explain describes why the action is or is not up to date.
+func (b *Builder) explain(a *Action) (string, error) {
+	if b.CacheDir == "" {
+		return "not cached: no cache dir", nil
+	}
+	old, err := b.loadRecord(a)
+	if err != nil {
+		return "", err
+	}
+	cur := a.rec
+	if old == nil {
+		return "not cached: no previous build", nil
+	}
+	if old.ID == cur.ID {
+		return "up to date", nil
+	}
+
+	var reasons []string
+	if old.Kind != cur.Kind {
+		reasons = append(reasons, fmt.Sprintf("kind changed from %s to %s", old.Kind, cur.Kind))
+	}
+	if old.Hash != cur.Hash {
+		if a.rule == nil {
+			reasons = append(reasons, "file changed")
+		} else {
+			reasons = append(reasons, "rule source changed")
+		}
+	}
+	reasons = append(reasons, diffRecordMap("attr", old.Attrs, cur.Attrs)...)
+	reasons = append(reasons, diffRecordMap("dep", old.Deps, cur.Deps)...)
+	reasons = append(reasons, diffRecordMap("input", old.Inputs, cur.Inputs)...)
+	return "not up to date: " + strings.Join(reasons, "; "), nil
+}
+
+func diffRecordMap(kind string, old, cur map[string]string) []string {
+	var keys []string
+	for key := range old {
+		keys = append(keys, key)
+	}
+	for key := range cur {
+		if _, ok := old[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var reasons []string
+	for _, key := range keys {
+		x, inOld := old[key]
+		y, inCur := cur[key]
+		switch {
+		case !inOld:
+			reasons = append(reasons, fmt.Sprintf("%s %s added", kind, key))
+		case !inCur:
+			reasons = append(reasons, fmt.Sprintf("%s %s removed", kind, key))
+		case x != y && kind == "attr":
+			reasons = append(reasons, fmt.Sprintf("attr %s changed from %s to %s", key, x, y))
+		case x != y:
+			reasons = append(reasons, fmt.Sprintf("%s %s changed", kind, key))
+		}
+	}
+	return reasons
+}
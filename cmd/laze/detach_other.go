@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import "os/exec"
+
+// detach is a no-op, the server is only detached from its stdio.
+func detach(cmd *exec.Cmd) {}
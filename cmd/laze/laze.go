@@ -6,6 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
 
 	"github.com/emcfarlane/laze"
 )
@@ -13,11 +17,70 @@ import (
 // TODO: add support for fmt starlark files on build.
 // laze fmt: https://github.com/bazelbuild/buildtools/blob/master/buildifier2/buildifier2.go
 
+var (
+	flagServer      = flag.Bool("server", false, "run the build on a background server")
+	flagIdleTimeout = flag.Duration("idle_timeout", 3*time.Hour, "server shutdown after idle duration")
+	flagVerbose     = flag.Bool("v", false, "log debug messages")
+	flagQuiet       = flag.Bool("quiet", false, "log errors only")
+)
+
+// logLevel is the log level set by flags.
+func logLevel() laze.LogLevel {
+	switch {
+	case *flagQuiet:
+		return laze.LevelError
+	case *flagVerbose:
+		return laze.LevelDebug
+	default:
+		return laze.LevelInfo
+	}
+}
+
 func run() error {
 	flag.Parse()
 
 	args := flag.Args()
 
+	if len(args) > 0 {
+		switch args[0] {
+		case "serve":
+			return serve()
+		case "shutdown":
+			return shutdown()
+		case "query":
+			return query(args[1:])
+		case "build":
+			return build(args[1:])
+		case "run":
+			return runLabel(args[1:])
+		case "test":
+			return test(args[1:])
+		}
+	}
+	return build(args)
+}
+
+// cacheDir is the default action cache directory.
+func cacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "laze")
+}
+
+// build builds the label.
+func build(args []string) error {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	dryRun := fs.Bool("dry_run", false, "print the planned actions without executing them")
+	explain := fs.Bool("explain", false, "print why each action is or is not up to date")
+	stamp := fs.Bool("stamp", false, "stamp outputs with the workspace status")
+	output := fs.String("output", "errors", "action output to print: errors, all or none")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	args = fs.Args()
+
 	if len(args) < 1 {
 		return fmt.Errorf("missing label")
 	}
@@ -25,16 +88,53 @@ func run() error {
 	label := args[len(args)-1]
 	args = args[:len(args)-1]
 
-	b := laze.Builder{
-		Dir: "", // TODO: configuration?
+	outputMode, err := laze.ParseOutputMode(*output)
+	if err != nil {
+		return err
+	}
+	opts := laze.BuildOptions{
+		DryRun:  *dryRun,
+		Explain: *explain,
+		Stamp:   *stamp,
+		Output:  outputMode,
+		Log:     logLevel(),
 	}
 
 	ctx := context.Background()
+	if *flagServer {
+		c, err := dialServer()
+		if err != nil {
+			return err
+		}
+		return c.Build(ctx, "", args, label, opts, os.Stderr)
+	}
+
+	b := laze.Builder{
+		Dir:      "", // TODO: configuration?
+		DryRun:   opts.DryRun,
+		Explain:  opts.Explain,
+		Stamp:    opts.Stamp,
+		Output:   opts.Output,
+		CacheDir: cacheDir(),
+		LogDir:   filepath.Join("laze-out", "logs"),
+		Print:    printStderr,
+		Log:      laze.NewLogger(os.Stderr, opts.Log),
+	}
+	if isTerminal(os.Stderr) {
+		b.Terminal = os.Stderr
+	}
+
 	a, err := b.Build(ctx, args, label)
 	if err != nil {
 		return err
 	}
 
+	if *dryRun {
+		if err := laze.WritePlan(os.Stdout, a); err != nil {
+			return err
+		}
+	}
+
 	// Report error on failed actions.
 	if err := a.FailureErr(); err != nil {
 		return err
@@ -42,6 +142,193 @@ func run() error {
 	return nil
 }
 
+// runLabel builds the label and runs the result with the remaining args.
+func runLabel(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	tag := fs.String("tag", "", "docker tag of loaded image targets, defaults to laze/<name>:latest")
+	stamp := fs.Bool("stamp", false, "stamp outputs with the workspace status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() < 1 {
+		return fmt.Errorf("usage: laze run [-tag=tag] [-stamp] label [args...]")
+	}
+	label, args := fs.Arg(0), fs.Args()[1:]
+
+	b := laze.Builder{
+		Dir:      "",
+		Stamp:    *stamp,
+		CacheDir: cacheDir(),
+		LogDir:   filepath.Join("laze-out", "logs"),
+		Print:    printStderr,
+		Log:      laze.NewLogger(os.Stderr, logLevel()),
+	}
+	if isTerminal(os.Stderr) {
+		b.Terminal = os.Stderr
+	}
+
+	ctx := context.Background()
+	a, err := b.Build(ctx, nil, label)
+	if err != nil {
+		return err
+	}
+	cmd, err := b.RunCommand(ctx, a, *tag, args)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		return err
+	}
+	return nil
+}
+
+// test builds and runs the test targets of the pattern.
+func test(args []string) error {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	filter := fs.String("test_filter", "", "filter of test cases passed to each test")
+	timeout := fs.Duration("test_timeout", 5*time.Minute, "timeout of tests without a timeout attr")
+	attempts := fs.Int("flaky_attempts", 3, "attempts of tests marked flaky")
+	noCache := fs.Bool("nocache_test_results", false, "rerun tests with cached passing results")
+	stamp := fs.Bool("stamp", false, "stamp outputs with the workspace status")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: laze test [flags] pattern")
+	}
+
+	b := laze.Builder{
+		Dir:      "",
+		Stamp:    *stamp,
+		CacheDir: cacheDir(),
+		LogDir:   filepath.Join("laze-out", "logs"),
+		Print:    printStderr,
+		Log:      laze.NewLogger(os.Stderr, logLevel()),
+	}
+	if isTerminal(os.Stderr) {
+		b.Terminal = os.Stderr
+	}
+
+	results, err := b.Test(context.Background(), fs.Arg(0), laze.TestOptions{
+		Filter:        *filter,
+		Timeout:       *timeout,
+		FlakyAttempts: *attempts,
+		NoCache:       *noCache,
+	})
+	if err != nil {
+		return err
+	}
+	if err := laze.WriteTestSummary(os.Stdout, results); err != nil {
+		return err
+	}
+	for _, r := range results {
+		if !r.Passed() {
+			os.Exit(1)
+		}
+	}
+	return nil
+}
+
+// printStderr prints action output to stderr.
+func printStderr(args ...interface{}) (int, error) {
+	return fmt.Fprint(os.Stderr, args...)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// query prints the result of a query expression.
+func query(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	output := fs.String("output", "label", "output format: label, json or dot")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: laze query [-output=label|json|dot] expr")
+	}
+
+	b := laze.Builder{
+		Dir: "",
+		Log: laze.NewLogger(os.Stderr, logLevel()),
+	}
+	actions, err := b.Query(context.Background(), fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return laze.WriteQuery(os.Stdout, *output, actions)
+}
+
+// serve runs the build server in the foreground.
+func serve() error {
+	socket, err := laze.ServerSocket("")
+	if err != nil {
+		return err
+	}
+	s := laze.Server{
+		Dir:         "",
+		CacheDir:    cacheDir(),
+		LogDir:      filepath.Join("laze-out", "logs"),
+		IdleTimeout: *flagIdleTimeout,
+	}
+	return s.ListenAndServe(context.Background(), socket)
+}
+
+// shutdown stops a running build server.
+func shutdown() error {
+	socket, err := laze.ServerSocket("")
+	if err != nil {
+		return err
+	}
+	c, err := laze.DialServer(socket)
+	if err != nil {
+		return nil // not running
+	}
+	return c.Shutdown(context.Background())
+}
+
+// dialServer connects to the build server, starting one if needed.
+func dialServer() (*laze.Client, error) {
+	socket, err := laze.ServerSocket("")
+	if err != nil {
+		return nil, err
+	}
+	if c, err := laze.DialServer(socket); err == nil {
+		return c, nil
+	}
+
+	cmd := exec.Command(os.Args[0],
+		"-idle_timeout", flagIdleTimeout.String(), "serve",
+	)
+	// Stdio is left nil, the null device, so the server doesn't hold the
+	// terminal.
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting server: %w", err)
+	}
+	go cmd.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c, err := laze.DialServer(socket)
+		if err == nil {
+			return c, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("server not responding: %w", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
 func main() {
 	if err := run(); err != nil {
 		log.Fatal(err)
@@ -1,16 +1,27 @@
 package laze
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/containerd/stargz-snapshotter/estargz"
-	"github.com/google/go-containerregistry/pkg/authn"
-	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/docker/docker/client"
 	cname "github.com/google/go-containerregistry/pkg/name"
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/cache"
+	"github.com/google/go-containerregistry/pkg/v1/daemon"
 	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
 	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/remote"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"go.starlark.net/starlark"
@@ -30,67 +41,363 @@ func newContainerModule(a *actions) *starlarkstruct.Module {
 	return &starlarkstruct.Module{
 		Name: "container",
 		Members: starlark.StringDict{
-			"pull":  starlark.NewBuiltin("container.pull", c.pull),
-			"build": starlark.NewBuiltin("container.build", c.build),
-			"push":  starlark.NewBuiltin("container.push", c.push),
+			"pull":       starlark.NewBuiltin("container.pull", c.pull),
+			"build":      starlark.NewBuiltin("container.build", c.build),
+			"index":      starlark.NewBuiltin("container.index", c.index),
+			"push":       starlark.NewBuiltin("container.push", c.push),
+			"load_image": starlark.NewBuiltin("container.load_image", c.load),
+			"sign":       starlark.NewBuiltin("container.sign", c.sign),
+			"attest":     starlark.NewBuiltin("container.attest", c.attest),
 		},
 	}
 }
 
-const imageConstructor starlark.String = "image"
+const (
+	imageConstructor      starlark.String = "image"
+	imageIndexConstructor starlark.String = "image_index"
+)
+
+// Image formats on disk.
+const (
+	formatDocker = "docker" // docker image tarball
+	formatOCI    = "oci"    // OCI image layout directory
+)
 
 // TODO: return starlark provider.
-func newImage(filename, reference string) starlark.Value {
+func newImage(filename, reference, format string) starlark.Value {
 	return starlarkstruct.FromStringDict(imageConstructor, map[string]starlark.Value{
 		"name":      starlark.String(filename),
 		"reference": starlark.String(reference),
+		"format":    starlark.String(format),
+	})
+}
+
+func checkFormat(format string) error {
+	switch format {
+	case formatDocker, formatOCI:
+		return nil
+	default:
+		return fmt.Errorf("unknown image format: %q", format)
+	}
+}
+
+// writeImage writes the image to filename in the format.
+func writeImage(filename string, ref cname.Reference, img v1.Image, format string) error {
+	if err := os.MkdirAll(path.Dir(filename), 0777); err != nil {
+		return err
+	}
+	if format == formatOCI {
+		// Rewrite the layout, blobs of previous builds are stale.
+		if err := os.RemoveAll(filename); err != nil {
+			return err
+		}
+		p, err := layout.Write(filename, empty.Index)
+		if err != nil {
+			return err
+		}
+		return p.AppendImage(img, layout.WithAnnotations(map[string]string{
+			"org.opencontainers.image.ref.name": ref.String(),
+		}))
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := tarball.Write(ref, img, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readLayoutImage reads the image of an OCI layout with a single image.
+func readLayoutImage(dir string) (v1.Image, error) {
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		return nil, err
+	}
+	if n := len(m.Manifests); n != 1 {
+		return nil, fmt.Errorf("layout %s: got %d manifests, want 1", dir, n)
+	}
+	return idx.Image(m.Manifests[0].Digest)
+}
+
+// newImageIndex is a multi-platform image written as an OCI layout.
+func newImageIndex(dir, reference string) starlark.Value {
+	return starlarkstruct.FromStringDict(imageIndexConstructor, map[string]starlark.Value{
+		"name":      starlark.String(dir),
+		"reference": starlark.String(reference),
 	})
 }
 
+// platform is the image platform of the action configuration, nil for the
+// host default.
+func (c *container) platform() *v1.Platform {
+	cfg := c.action.config
+	if cfg == (configuration{}) {
+		return nil
+	}
+	p := &v1.Platform{OS: cfg.goos, Architecture: cfg.goarch}
+	if p.OS == "" {
+		p.OS = runtime.GOOS
+	}
+	if p.Architecture == "" {
+		p.Architecture = runtime.GOARCH
+	}
+	return p
+}
+
+// remote returns the reference to request and the remote options of ref
+// with the workspace registry config.
+func (c *container) remote(ref cname.Reference) (cname.Reference, []remote.Option, error) {
+	return c.builder.remoteRef(c.ctx, ref, false)
+}
+
+// pullRemote is remote for pulls, requesting the registry's mirror.
+func (c *container) pullRemote(ref cname.Reference) (cname.Reference, []remote.Option, error) {
+	return c.builder.remoteRef(c.ctx, ref, true)
+}
+
+// loadImage loads the image of an image provider target.
+func loadImage(t *target) (v1.Image, error) {
+	imageProvider, err := t.action.loadStructValue(imageConstructor)
+	if err != nil {
+		return nil, fmt.Errorf("image provider: %w", err)
+	}
+
+	// TODO: should it be a file provider?
+	filename, err := imageProvider.AttrString("name")
+	if err != nil {
+		return nil, err
+	}
+	format, err := imageProvider.AttrString("format")
+	if err != nil {
+		return nil, err
+	}
+	reference, err := imageProvider.AttrString("reference")
+	if err != nil {
+		return nil, err
+	}
+	return loadImageFile(filename, reference, format)
+}
+
+// loadImageFile loads the image written in the format. Docker tarballs
+// select the image by tag, tarballs of digest references have one image.
+func loadImageFile(filename, reference, format string) (v1.Image, error) {
+	if format == formatOCI {
+		img, err := readLayoutImage(filename)
+		if err != nil {
+			return nil, fmt.Errorf("loading image: %w", err)
+		}
+		return img, nil
+	}
+
+	var tag *cname.Tag
+	if _, err := cname.NewDigest(reference, cname.StrictValidation); err != nil {
+		t, err := cname.NewTag(reference, cname.StrictValidation)
+		if err != nil {
+			return nil, fmt.Errorf("image reference: %w", err)
+		}
+		tag = &t
+	}
+
+	// Load image from filesystem.
+	img, err := tarball.ImageFromPath(filename, tag)
+	if err != nil {
+		return nil, fmt.Errorf("loading image: %w", err)
+	}
+	return img, nil
+}
+
+// parsePlatform parses an "os/arch[/variant]" platform.
+func parsePlatform(s string) (*v1.Platform, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid platform %q, want os/arch[/variant]", s)
+	}
+	p := &v1.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// pullRecord is the resolved image of a pull, saved next to the output to
+// verify it without the registry.
+type pullRecord struct {
+	Reference string `json:"reference"`
+	Platform  string `json:"platform,omitempty"`
+	Format    string `json:"format"`
+	Digest    string `json:"digest"` // image manifest digest
+	Config    string `json:"config"` // image config digest
+}
+
+// imageConfigName is the config digest of the image written to filename,
+// identifying its contents in either format.
+func imageConfigName(filename, reference, format string) (v1.Hash, error) {
+	img, err := loadImageFile(filename, reference, format)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+	return img.ConfigName()
+}
+
+// blobCache is the content addressed layer cache shared by pulls of every
+// workspace, nil without a cache dir.
+func (b *Builder) blobCache() cache.Cache {
+	if b.CacheDir == "" {
+		return nil
+	}
+	return cache.NewFilesystemCache(filepath.Join(b.CacheDir, "blobs"))
+}
+
 func (c *container) pull(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
 		rname     string
 		reference string
+		digest    string
+		platform  string
+		format    = formatDocker
 	)
 	if err := starlark.UnpackArgs(
 		"container_pull", args, kwargs,
-		"name", &rname, "reference", &reference,
+		"name", &rname,
+		"reference", &reference,
+		"digest?", &digest,
+		"platform?", &platform,
+		"format?", &format,
 	); err != nil {
 		return nil, err
 	}
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
 
-	ref, err := name.ParseReference(reference)
+	ref, err := cname.ParseReference(reference)
 	if err != nil {
 		return nil, err
 	}
-	ref.Context()
+	// Digests pin the reference, tags name the image written.
+	var pinned cname.Reference = ref
+	if digest != "" {
+		if _, err := v1.NewHash(digest); err != nil {
+			return nil, fmt.Errorf("digest: %w", err)
+		}
+		if pinned, err = cname.NewDigest(ref.Context().String() + "@" + digest); err != nil {
+			return nil, err
+		}
+	}
 
-	img, err := remote.Image(ref,
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
-		remote.WithContext(c.ctx),
-	)
+	// The platform attr overrides the configured platform.
+	p := c.platform()
+	if platform != "" {
+		if p, err = parsePlatform(platform); err != nil {
+			return nil, err
+		}
+	}
+	var platformStr string
+	if p != nil {
+		platformStr = p.OS + "/" + p.Architecture
+		if p.Variant != "" {
+			platformStr += "/" + p.Variant
+		}
+	}
+
+	cmdArgs := []string{pinned.String(), "format=" + format}
+	if platformStr != "" {
+		cmdArgs = append(cmdArgs, "platform="+platformStr)
+	}
+	filename := c.out
+	recordFile := filename + ".pull"
+	if c.record(&command{
+		Name:    "container.pull",
+		Args:    cmdArgs,
+		Outputs: []string{filename, recordFile},
+	}) {
+		return newImage(filename, reference, format), nil
+	}
+
+	// Pinned pulls are verified against the record without the registry.
+	var rec pullRecord
+	if data, err := os.ReadFile(recordFile); err == nil && json.Unmarshal(data, &rec) == nil {
+		if digest != "" && rec.Reference == pinned.String() && rec.Platform == platformStr && rec.Format == format {
+			if h, err := imageConfigName(filename, reference, format); err == nil && h.String() == rec.Config {
+				c.builder.Log.Debugf("%s: %s is up to date", c.key, pinned)
+				return withAttrs(newImage(filename, reference, format), starlark.StringDict{
+					"digest": starlark.String(rec.Digest),
+				}), nil
+			}
+		}
+	}
+
+	rref, opts, err := c.pullRemote(pinned)
+	if err != nil {
+		return nil, err
+	}
+	if p != nil {
+		opts = append(opts, remote.WithPlatform(*p))
+	}
+	img, err := remote.Image(rref, opts...)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if platform != "" && (cfg.OS != p.OS || cfg.Architecture != p.Architecture) {
+		return nil, fmt.Errorf("%s: got platform %s/%s, want %s", pinned, cfg.OS, cfg.Architecture, platformStr)
+	}
+	imgDigest, err := img.Digest()
+	if err != nil {
+		return nil, err
+	}
+	configName, err := img.ConfigName()
 	if err != nil {
 		return nil, err
 	}
 
-	// TODO: caching...
-	// HACK: lets just stat the existance of the file
-	filename := c.key
-	if _, err := os.Stat(filename); err != nil {
-		f, err := os.Create(filename)
-		if err != nil {
-			panic(err)
+	// Rewrite the output unless it has the image, layers are read
+	// through the blob cache.
+	if h, err := imageConfigName(filename, reference, format); err == nil && h == configName {
+		c.builder.Log.Debugf("%s: %s is up to date", c.key, pinned)
+	} else {
+		if bc := c.builder.blobCache(); bc != nil {
+			img = cache.Image(img, bc)
 		}
-		defer f.Close()
-
-		if err := tarball.Write(ref, img, f); err != nil {
+		c.builder.Log.Debugf("%s: pulling %s", c.key, imgDigest)
+		if err := writeImage(filename, ref, img, format); err != nil {
 			return nil, err
 		}
 	}
-	return newImage(filename, reference), nil
+
+	data, err := json.Marshal(pullRecord{
+		Reference: pinned.String(),
+		Platform:  platformStr,
+		Format:    format,
+		Digest:    imgDigest.String(),
+		Config:    configName.String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(recordFile, data, 0666); err != nil {
+		return nil, err
+	}
+	return withAttrs(newImage(filename, reference, format), starlark.StringDict{
+		"digest": starlark.String(imgDigest.String()),
+	}), nil
 }
 
 func listToStrings(l *starlark.List) ([]string, error) {
+	if l == nil {
+		return nil, nil
+	}
 	iter := l.Iterate()
 	defer iter.Done()
 
@@ -107,24 +414,235 @@ func listToStrings(l *starlark.List) ([]string, error) {
 	return ss, nil
 }
 
+func dictToStrings(d *starlark.Dict) (map[string]string, error) {
+	if d == nil {
+		return nil, nil
+	}
+	m := make(map[string]string, d.Len())
+	for _, item := range d.Items() {
+		key, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid string dict key: %s", item[0])
+		}
+		val, ok := starlark.AsString(item[1])
+		if !ok {
+			return nil, fmt.Errorf("invalid string dict value: %s", item[1])
+		}
+		m[key] = val
+	}
+	return m, nil
+}
+
+// imageConfig is the runtime configuration set by container_build.
+type imageConfig struct {
+	env          map[string]string
+	labels       map[string]string
+	annotations  map[string]string // manifest annotations
+	cmd          []string
+	workdir      string
+	user         string
+	exposedPorts []string // port[/protocol], protocol defaults to tcp
+	volumes      []string
+	stopSignal   string
+}
+
+// stamp expands stamp values in env, labels and annotations.
+func (ic *imageConfig) stamp(values map[string]string) {
+	for _, m := range []map[string]string{ic.env, ic.labels, ic.annotations} {
+		for key, val := range m {
+			m[key] = expandStamp(val, values)
+		}
+	}
+}
+
+// apply sets the configuration on the base config. Env vars and labels
+// are merged with the base, overriding values of the same key.
+func (ic *imageConfig) apply(cfg *v1.Config) {
+	if len(ic.env) > 0 {
+		seen := make(map[string]bool)
+		for i, kv := range cfg.Env {
+			key := strings.SplitN(kv, "=", 2)[0]
+			if val, ok := ic.env[key]; ok {
+				cfg.Env[i] = key + "=" + val
+				seen[key] = true
+			}
+		}
+		keys := make([]string, 0, len(ic.env))
+		for key := range ic.env {
+			if !seen[key] {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			cfg.Env = append(cfg.Env, key+"="+ic.env[key])
+		}
+	}
+	if len(ic.labels) > 0 {
+		if cfg.Labels == nil {
+			cfg.Labels = make(map[string]string)
+		}
+		for key, val := range ic.labels {
+			cfg.Labels[key] = val
+		}
+	}
+	if len(ic.cmd) > 0 {
+		cfg.Cmd = ic.cmd
+	}
+	if ic.workdir != "" {
+		cfg.WorkingDir = ic.workdir
+	}
+	if ic.user != "" {
+		cfg.User = ic.user
+	}
+	if len(ic.exposedPorts) > 0 {
+		if cfg.ExposedPorts == nil {
+			cfg.ExposedPorts = make(map[string]struct{})
+		}
+		for _, port := range ic.exposedPorts {
+			if !strings.Contains(port, "/") {
+				port += "/tcp"
+			}
+			cfg.ExposedPorts[port] = struct{}{}
+		}
+	}
+	if len(ic.volumes) > 0 {
+		if cfg.Volumes == nil {
+			cfg.Volumes = make(map[string]struct{})
+		}
+		for _, volume := range ic.volumes {
+			cfg.Volumes[volume] = struct{}{}
+		}
+	}
+	if ic.stopSignal != "" {
+		cfg.StopSignal = ic.stopSignal
+	}
+}
+
+// annotatedImage adds annotations to the manifest of an image.
+type annotatedImage struct {
+	v1.Image
+	annotations map[string]string
+}
+
+func (i *annotatedImage) Manifest() (*v1.Manifest, error) {
+	m, err := i.Image.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	m = m.DeepCopy()
+	if m.Annotations == nil {
+		m.Annotations = make(map[string]string)
+	}
+	for key, val := range i.annotations {
+		m.Annotations[key] = val
+	}
+	return m, nil
+}
+
+func (i *annotatedImage) RawManifest() ([]byte, error) {
+	m, err := i.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(m)
+}
+
+func (i *annotatedImage) Digest() (v1.Hash, error) { return partial.Digest(i) }
+func (i *annotatedImage) Size() (int64, error)     { return partial.Size(i) }
+
 func (c *container) build(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
 		name            string
 		entrypointList  *starlark.List
-		tar             *target
-		base            *target
+		tarValue        starlark.Value = starlark.None
+		layersList      *starlark.List
+		baseValue       starlark.Value = starlark.None
 		prioritizedList *starlark.List
+		format          = formatDocker
+
+		envDict, labelsDict, annotationsDict *starlark.Dict
+		cmdList, portsList, volumesList      *starlark.List
+		ic                                   imageConfig
+		stamp                                bool
+		created                              string
+		reference                            string
 	)
 	if err := starlark.UnpackArgs(
 		"container_build", args, kwargs,
 		"name", &name,
 		"entrypoint", &entrypointList,
-		"tar", &tar,
-		"base?", &base,
+		"tar?", &tarValue,
+		"layers?", &layersList,
+		"base?", &baseValue,
 		"prioritized_files?", &prioritizedList,
+		"format?", &format,
+		"env?", &envDict,
+		"labels?", &labelsDict,
+		"annotations?", &annotationsDict,
+		"cmd?", &cmdList,
+		"workdir?", &ic.workdir,
+		"user?", &ic.user,
+		"exposed_ports?", &portsList,
+		"volumes?", &volumesList,
+		"stop_signal?", &ic.stopSignal,
+		"stamp?", &stamp,
+		"creation_time?", &created,
+		"reference?", &reference,
 	); err != nil {
 		return nil, err
 	}
+	if err := checkFormat(format); err != nil {
+		return nil, err
+	}
+	ref, err := c.reference(reference)
+	if err != nil {
+		return nil, err
+	}
+	reference = ref.Name()
+
+	for _, x := range []struct {
+		dict *starlark.Dict
+		m    *map[string]string
+	}{
+		{envDict, &ic.env},
+		{labelsDict, &ic.labels},
+		{annotationsDict, &ic.annotations},
+	} {
+		if *x.m, err = dictToStrings(x.dict); err != nil {
+			return nil, err
+		}
+	}
+	for _, x := range []struct {
+		list *starlark.List
+		ss   *[]string
+	}{
+		{cmdList, &ic.cmd},
+		{portsList, &ic.exposedPorts},
+		{volumesList, &ic.volumes},
+	} {
+		if *x.ss, err = listToStrings(x.list); err != nil {
+			return nil, err
+		}
+	}
+	if len(ic.annotations) > 0 && format != formatOCI {
+		return nil, fmt.Errorf("annotations require the %q format", formatOCI)
+	}
+	if stamp {
+		ic.stamp(c.builder.stampAction(c.action))
+	}
+	// Binaries find their data files under LAZE_DATA_PATH, env may
+	// override it.
+	if _, ok := ic.env["LAZE_DATA_PATH"]; !ok {
+		if ic.env == nil {
+			ic.env = make(map[string]string)
+		}
+		ic.env["LAZE_DATA_PATH"] = "/"
+	}
+	createdAt, err := creationTime(created)
+	if err != nil {
+		return nil, err
+	}
 
 	// TODO: load tag from provider?
 	entrypoint, err := listToStrings(entrypointList)
@@ -136,73 +654,68 @@ func (c *container) build(thread *starlark.Thread, b *starlark.Builtin, args sta
 		return nil, err
 	}
 
+	if c.record(&command{
+		Name:    "container.build",
+		Args:    []string{fmt.Sprintf("entrypoint=%q", entrypoint), "format=" + format},
+		Outputs: []string{c.out},
+	}) {
+		return newImage(c.out, reference, format), nil
+	}
+
 	baseImage := empty.Image
-	if base != nil {
-		// Load base iamge from local.
-		imageProvider, err := base.action.loadStructValue(imageConstructor)
+	if base, ok := baseValue.(*target); ok {
+		// Load base image from local.
+		img, err := loadImage(base)
 		if err != nil {
-			return nil, fmt.Errorf("image provider: %w", err)
+			return nil, err
 		}
+		baseImage = img
+	}
 
-		// TODO: should it be a file provider?
-		filename, err := imageProvider.AttrString("name")
-		if err != nil {
-			return nil, err
+	// Each layer target is a layer in order, followed by tar.
+	var targets []*target
+	if layersList != nil {
+		for i := 0; i < layersList.Len(); i++ {
+			t, ok := layersList.Index(i).(*target)
+			if !ok {
+				return nil, fmt.Errorf("invalid layer type: %s", layersList.Index(i).Type())
+			}
+			targets = append(targets, t)
 		}
+	}
+	if t, ok := tarValue.(*target); ok {
+		targets = append(targets, t)
+	}
 
-		reference, err := imageProvider.AttrString("reference")
+	var layers []mutate.Addendum
+	for _, t := range targets {
+		fileProvider, err := t.action.loadStructValue(fileConstructor)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", t.label, err)
 		}
-
-		tag, err := cname.NewTag(reference, cname.StrictValidation)
+		filename, err := fileProvider.AttrString("path")
 		if err != nil {
 			return nil, err
 		}
 
-		// Load base from filesystem.
-		img, err := tarball.ImageFromPath(filename, &tag)
+		imageLayer, err := c.builder.layerFromFile(filename, createdAt,
+			tarball.WithEstargzOptions(estargz.WithPrioritizedFiles(
+				// When using estargz, prioritize downloading the binary entrypoint.
+				prioritizedFiles,
+			)),
+		)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %w", t.label, err)
 		}
-		baseImage = img
-	}
-
-	var layers []mutate.Addendum
-
-	tarStruct, err := tar.action.loadStructValue(fileConstructor)
-	if err != nil {
-		return nil, err
+		layers = append(layers, mutate.Addendum{
+			Layer: imageLayer,
+			History: v1.History{
+				Author:    "laze",
+				Created:   v1.Time{Time: createdAt},
+				CreatedBy: "laze " + t.label,
+			},
+		})
 	}
-	tarFilename, err := tarStruct.AttrString("path")
-	if err != nil {
-		return nil, err
-	}
-
-	r, err := os.Open(tarFilename)
-	if err != nil {
-		return nil, err
-	}
-	defer r.Close()
-
-	imageLayer, err := tarball.LayerFromReader(
-		r, tarball.WithCompressedCaching,
-		tarball.WithEstargzOptions(estargz.WithPrioritizedFiles(
-			// When using estargz, prioritize downloading the binary entrypoint.
-			prioritizedFiles,
-		)),
-	)
-	if err != nil {
-		return nil, err
-	}
-	layers = append(layers, mutate.Addendum{
-		Layer: imageLayer,
-		History: v1.History{
-			Author:    "laze",
-			CreatedBy: "laze " + name,
-			Comment:   "ship it real good",
-		},
-	})
 
 	// Augment the base image with our application layer.
 	appImage, err := mutate.Append(baseImage, layers...)
@@ -218,105 +731,341 @@ func (c *container) build(thread *starlark.Thread, b *starlark.Builtin, args sta
 	}
 	cfg = cfg.DeepCopy()
 	cfg.Config.Entrypoint = entrypoint
-	//updatePath(cfg)
-	cfg.Config.Env = append(cfg.Config.Env, "LAZE_DATA_PATH="+"/") // TODO
 	cfg.Author = "github.com/emcfarlane/laze"
-
-	if cfg.Config.Labels == nil {
-		cfg.Config.Labels = map[string]string{}
+	cfg.Created = v1.Time{Time: createdAt}
+	if p := c.platform(); p != nil {
+		cfg.OS = p.OS
+		cfg.Architecture = p.Architecture
 	}
-	// TODO: Add support for labels.
-	//for k, v := range labels {
-	//	cfg.Config.Labels[k] = v
-	//}
+	ic.apply(&cfg.Config)
 
 	img, err := mutate.ConfigFile(appImage, cfg)
 	if err != nil {
 		return nil, err
 	}
+	if len(ic.annotations) > 0 {
+		img = &annotatedImage{Image: img, annotations: ic.annotations}
+	}
 
-	//empty := v1.Time{}
-	//if g.creationTime != empty {
-	//	return mutate.CreatedAt(image, g.creationTime)
-	//}
-
-	filename := c.key
-	f, err := os.Create(filename)
-	if err != nil {
-		panic(err)
+	filename := c.out
+	if err := writeImage(filename, ref, img, format); err != nil {
+		return nil, err
 	}
-	defer f.Close()
+	return newImage(filename, reference, format), nil
+}
 
-	reference := "gcr.io/foo/bar:latest" // TODO: Reference?
-	ref, err := cname.ParseReference(reference)
+// index assembles the images built for each platform into an image index,
+// written as an OCI layout directory.
+func (c *container) index(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name      string
+		images    *starlark.List
+		reference string
+	)
+	if err := starlark.UnpackArgs(
+		"container_index", args, kwargs,
+		"name", &name,
+		"images", &images,
+		"reference?", &reference,
+	); err != nil {
+		return nil, err
+	}
+	ref, err := c.reference(reference)
 	if err != nil {
 		return nil, err
 	}
+	reference = ref.Name()
 
-	if err := tarball.Write(ref, img, f); err != nil {
+	dir := c.out
+	if c.record(&command{
+		Name:    "container.index",
+		Args:    []string{fmt.Sprintf("images=%d", images.Len())},
+		Outputs: []string{dir},
+	}) {
+		return newImageIndex(dir, reference), nil
+	}
+
+	var adds []mutate.IndexAddendum
+	for i := 0; i < images.Len(); i++ {
+		t, ok := images.Index(i).(*target)
+		if !ok {
+			return nil, fmt.Errorf("invalid image type: %s", images.Index(i).Type())
+		}
+		img, err := loadImage(t)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", t.label, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		mediaType, err := img.MediaType()
+		if err != nil {
+			return nil, err
+		}
+		adds = append(adds, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				MediaType: mediaType,
+				Platform: &v1.Platform{
+					OS:           cfg.OS,
+					Architecture: cfg.Architecture,
+				},
+			},
+		})
+	}
+	idx := mutate.AppendManifests(empty.Index, adds...)
+
+	// Rewrite the layout, blobs of previous builds are stale.
+	if err := os.RemoveAll(dir); err != nil {
 		return nil, err
 	}
-	return newImage(filename, reference), nil
+	if _, err := layout.Write(dir, idx); err != nil {
+		return nil, err
+	}
+	return newImageIndex(dir, reference), nil
 }
 
+// withDigest returns the image provider referencing the pushed digest,
+// with the digest and the file it was written to.
+func withDigest(v starlark.Value, digestRef cname.Digest, digestFile string) starlark.Value {
+	s := v.(*starlarkstruct.Struct)
+	d := make(starlark.StringDict)
+	s.ToStringDict(d)
+	d["reference"] = starlark.String(digestRef.String())
+	d["digest"] = starlark.String(digestRef.DigestStr())
+	d["digest_file"] = starlark.String(digestFile)
+	return starlarkstruct.FromStringDict(s.Constructor(), d)
+}
+
+// push uploads an image or image index to the registry, tagging it with
+// each of tags. Blobs and manifests already in the registry are skipped.
+// The pushed name@sha256 digest is written to the output digest file.
 func (c *container) push(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	fmt.Println("RUNNING CONTAINER PUSH")
 	var (
 		name      string
 		image     *target
 		reference string
+		tagsList  *starlark.List
 	)
 	if err := starlark.UnpackArgs(
 		"container_push", args, kwargs,
 		"name", &name,
 		"image", &image,
 		"reference", &reference,
+		"tags?", &tagsList,
 	); err != nil {
-		fmt.Println("failed on starlark")
 		return nil, err
 	}
-
-	imageProvider, err := image.action.loadStructValue(imageConstructor)
+	tags, err := listToStrings(tagsList)
 	if err != nil {
-		return nil, fmt.Errorf("image provider: %w", err)
+		return nil, err
 	}
 
-	// TODO: should it be a file provider?
-	filename, err := imageProvider.AttrString("name")
+	digestFile := c.out + ".digest"
+	if c.record(&command{
+		Name:    "container.push",
+		Args:    append([]string{reference}, tags...),
+		Outputs: []string{digestFile},
+	}) {
+		return newImage(c.key, reference, formatDocker), nil
+	}
+
+	ref, err := cname.ParseReference(reference)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("push reference: %w", err)
 	}
-	imageRef, err := imageProvider.AttrString("reference")
+	rref, opts, err := c.remote(ref)
 	if err != nil {
 		return nil, err
 	}
 
-	tag, err := cname.NewTag(imageRef, cname.StrictValidation)
+	// Image indexes are pushed with their manifests.
+	var (
+		digest v1.Hash
+		write  func() error
+	)
+	if indexProvider, err := image.action.loadStructValue(imageIndexConstructor); err == nil {
+		dir, err := indexProvider.AttrString("name")
+		if err != nil {
+			return nil, err
+		}
+		idx, err := layout.ImageIndexFromPath(dir)
+		if err != nil {
+			return nil, fmt.Errorf("loading index: %w", err)
+		}
+		if digest, err = idx.Digest(); err != nil {
+			return nil, err
+		}
+		write = func() error { return remote.WriteIndex(rref, idx, opts...) }
+	} else {
+		img, err := loadImage(image)
+		if err != nil {
+			return nil, err
+		}
+		if digest, err = img.Digest(); err != nil {
+			return nil, err
+		}
+		write = func() error { return remote.Write(rref, img, opts...) }
+	}
+
+	// Skip the push if the registry has the manifest.
+	if desc, err := remote.Head(rref, opts...); err == nil && desc.Digest == digest {
+		c.builder.Log.Debugf("%s: %s is up to date", c.key, ref)
+	} else {
+		c.builder.Log.Debugf("%s: pushing %s to %s", c.key, digest, ref)
+		if err := write(); err != nil {
+			return nil, fmt.Errorf("pushing %s: %w", ref, err)
+		}
+	}
+
+	if len(tags) > 0 {
+		desc, err := remote.Get(rref, opts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			t, err := cname.NewTag(ref.Context().String() + ":" + tag)
+			if err != nil {
+				return nil, fmt.Errorf("tag: %w", err)
+			}
+			rt, opts, err := c.remote(t)
+			if err != nil {
+				return nil, err
+			}
+			if err := remote.Tag(rt.(cname.Tag), desc, opts...); err != nil {
+				return nil, fmt.Errorf("tagging %s: %w", t, err)
+			}
+		}
+	}
+
+	digestRef, err := cname.NewDigest(ref.Context().String() + "@" + digest.String())
 	if err != nil {
-		fmt.Println("FAILED ON tag")
 		return nil, err
 	}
+	if err := os.MkdirAll(path.Dir(digestFile), 0777); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(digestFile, []byte(digestRef.String()+"\n"), 0666); err != nil {
+		return nil, err
+	}
+	return withDigest(image.action.Value, digestRef, digestFile), nil
+}
 
-	// Load base from filesystem.
-	img, err := tarball.ImageFromPath(filename, &tag)
+// errNoDaemon is returned when the docker daemon can't be reached.
+var errNoDaemon = errors.New("docker daemon not available")
+
+// daemonWrite loads the image into the docker daemon as tag.
+func (b *Builder) daemonWrite(ctx context.Context, tag cname.Tag, img v1.Image) error {
+	cli, err := client.NewClientWithOpts(client.FromEnv)
 	if err != nil {
-		fmt.Println("FAILED ON image load")
-		return nil, err
+		return fmt.Errorf("%w: %v", errNoDaemon, err)
+	}
+	defer cli.Close()
+	if _, err := cli.Ping(ctx); err != nil {
+		return fmt.Errorf("%w: %v", errNoDaemon, err)
 	}
 
+	resp, err := daemon.Write(tag, img, daemon.WithClient(cli), daemon.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	b.Log.Debugf("loaded %s: %s", tag, strings.TrimSpace(resp))
+	return nil
+}
+
+// reference parses the reference of a built image, defaulting to the tag
+// named after the target.
+func (c *container) reference(reference string) (cname.Reference, error) {
+	if reference == "" {
+		return defaultTag(c.key)
+	}
 	ref, err := cname.ParseReference(reference)
 	if err != nil {
-		fmt.Println("FAILED ON REF")
-		return nil, err
+		return nil, fmt.Errorf("image reference: %w", err)
+	}
+	return ref, nil
+}
+
+// defaultTag is the tag of an image target without a reference, named
+// after the label: "testdata/container/hello.tar" is "laze/hello:latest".
+func defaultTag(key string) (cname.Tag, error) {
+	base := strings.ToLower(path.Base(key))
+	if i := strings.Index(base, "."); i > 0 {
+		base = base[:i]
 	}
+	return cname.NewTag("laze/" + base + ":latest")
+}
 
-	if err := remote.Write(ref, img,
-		remote.WithAuthFromKeychain(authn.DefaultKeychain),
-		remote.WithContext(c.ctx),
+func (c *container) load(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name    string
+		image   *target
+		tagName string
+		tarOut  bool
+	)
+	if err := starlark.UnpackArgs(
+		"container_load", args, kwargs,
+		"name", &name,
+		"image", &image,
+		"tag?", &tagName,
+		"tar?", &tarOut,
 	); err != nil {
-		fmt.Println("failing here?", err)
 		return nil, err
 	}
-	fmt.Println("DONE CONTAINER PUSH")
-	return newImage(filename, reference), nil
+
+	var (
+		tag cname.Tag
+		err error
+	)
+	if tagName == "" {
+		tag, err = defaultTag(image.action.Key)
+	} else {
+		tag, err = cname.NewTag(tagName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("load tag: %w", err)
+	}
+
+	// Write a tarball for "docker load" instead of the daemon.
+	if tarOut {
+		if c.record(&command{
+			Name:    "container.load",
+			Args:    []string{"-tar", tag.String()},
+			Outputs: []string{c.out},
+		}) {
+			return newImage(c.out, tag.String(), formatDocker), nil
+		}
+		img, err := loadImage(image)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeImage(c.out, tag, img, formatDocker); err != nil {
+			return nil, err
+		}
+		return newImage(c.out, tag.String(), formatDocker), nil
+	}
+
+	if c.record(&command{
+		Name: "container.load",
+		Args: []string{tag.String()},
+	}) {
+		return withAttrs(image.action.Value, starlark.StringDict{
+			"tag": starlark.String(tag.String()),
+		}), nil
+	}
+
+	img, err := loadImage(image)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.builder.daemonWrite(c.ctx, tag, img); err != nil {
+		if errors.Is(err, errNoDaemon) {
+			return nil, fmt.Errorf("%w (set tar = True to write a tarball for \"docker load\")", err)
+		}
+		return nil, fmt.Errorf("loading %s: %w", tag, err)
+	}
+	return withAttrs(image.action.Value, starlark.StringDict{
+		"tag": starlark.String(tag.String()),
+	}), nil
 }
@@ -0,0 +1,975 @@
+package laze
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+)
+
+func TestContainerIndex(t *testing.T) {
+	b := Builder{}
+
+	ctx := context.Background()
+	a, err := b.Build(ctx, nil, "testdata/container/hello_index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.loadStructValue(imageIndexConstructor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := s.AttrString("name")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := layout.ImageIndexFromPath(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := idx.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, desc := range m.Manifests {
+		img, err := idx.Image(desc.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.OS != desc.Platform.OS || cfg.Architecture != desc.Platform.Architecture {
+			t.Errorf("%s: config platform %s/%s, want %s/%s", desc.Digest,
+				cfg.OS, cfg.Architecture, desc.Platform.OS, desc.Platform.Architecture)
+		}
+		got = append(got, desc.Platform.OS+"/"+desc.Platform.Architecture)
+	}
+	if want := []string{"linux/amd64", "linux/arm64"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("got platforms %v, want %v", got, want)
+	}
+
+	// Go targets are built for each platform.
+	for _, label := range []string{
+		"file://testdata/go/hello?goarch=amd64&goos=linux",
+		"file://testdata/go/hello?goarch=arm64&goos=linux",
+	} {
+		if _, ok := b.actionCache[label]; !ok {
+			t.Errorf("missing transitioned action %s", label)
+		}
+	}
+	if _, err := os.Stat("laze-out/linux_arm64/testdata/go/hello"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContainerFormat(t *testing.T) {
+	b := Builder{}
+
+	ctx := context.Background()
+	a, err := b.Build(ctx, nil, "testdata/container/hello_from_oci.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The base is an OCI layout, the image a docker tarball.
+	for label, want := range map[string]string{
+		"file://testdata/container/hello_oci":          "oci",
+		"file://testdata/container/hello_from_oci.tar": "docker",
+	} {
+		s, err := b.actionCache[label].loadStructValue(imageConstructor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.AttrString("format"); err != nil || got != want {
+			t.Errorf("%s: got format %q, %v, want %q", label, got, err, want)
+		}
+	}
+	if _, err := os.Stat("testdata/container/hello_oci/oci-layout"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Built images are tagged after the target.
+	s, err := a.loadStructValue(imageConstructor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := s.AttrString("reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "index.docker.io/laze/hello_from_oci:latest"; reference != want {
+		t.Errorf("got reference %q, want %q", reference, want)
+	}
+	tag, err := name.NewTag(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tarball.ImageFromPath("testdata/container/hello_from_oci.tar", &tag); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := loadImage(newTarget("hello_from_oci.tar", a))
+	if err != nil {
+		t.Fatal(err)
+	}
+	layers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(layers) != 2 {
+		t.Fatalf("got %d layers, want base and app layer", len(layers))
+	}
+}
+
+func TestContainerConfig(t *testing.T) {
+	b := Builder{Stamp: true}
+
+	ctx := context.Background()
+	a, err := b.Build(ctx, nil, "testdata/container/hello_oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := readLayoutImage("testdata/container/hello_oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := b.stampValues()["STABLE_GIT_COMMIT"]
+	if commit == "" {
+		t.Fatal("missing STABLE_GIT_COMMIT stamp")
+	}
+
+	c := cfg.Config
+	for _, check := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"env", c.Env, []string{"HELLO=world", "LAZE_DATA_PATH=/"}},
+		{"labels", c.Labels, map[string]string{"org.opencontainers.image.revision": commit}},
+		{"cmd", c.Cmd, []string{"--help"}},
+		{"workdir", c.WorkingDir, "/tmp"},
+		{"user", c.User, "nonroot"},
+		{"exposed_ports", c.ExposedPorts, map[string]struct{}{"8080/tcp": {}, "9090/udp": {}}},
+		{"volumes", c.Volumes, map[string]struct{}{"/data": {}}},
+		{"stop_signal", c.StopSignal, "SIGINT"},
+	} {
+		if fmt.Sprint(check.got) != fmt.Sprint(check.want) {
+			t.Errorf("%s: got %v, want %v", check.name, check.got, check.want)
+		}
+	}
+
+	m, err := img.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := m.Annotations["org.opencontainers.image.source"], "https://github.com/emcfarlane/laze"; got != want {
+		t.Errorf("annotation got %q, want %q", got, want)
+	}
+}
+
+func TestContainerLayers(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	build := func() []v1.Hash {
+		b := Builder{CacheDir: cacheDir}
+		a, err := b.Build(context.Background(), nil, "testdata/container/hello_layers.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.FailureErr(); err != nil {
+			t.Fatal(err)
+		}
+		img, err := loadImage(newTarget("hello_layers.tar", a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var digests []v1.Hash
+		for _, layer := range layers {
+			digest, err := layer.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			digests = append(digests, digest)
+		}
+		return digests
+	}
+
+	first := build()
+	if len(first) != 2 {
+		t.Fatalf("got %d layers, want 2", len(first))
+	}
+	cached, err := filepath.Glob(filepath.Join(cacheDir, "layers", "*.tar.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 2 {
+		t.Fatalf("got %d cached layers, want 2", len(cached))
+	}
+	modTimes := make(map[string]time.Time)
+	for _, name := range cached {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		modTimes[name] = fi.ModTime()
+	}
+
+	// Rebuilds reuse the cached layers.
+	second := build()
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("layer digests changed: %v != %v", first, second)
+	}
+	for name, modTime := range modTimes {
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(modTime) {
+			t.Errorf("cached layer %s rewritten", name)
+		}
+	}
+}
+
+func TestContainerArchiveLayers(t *testing.T) {
+	diffIDs := func(name string) []v1.Hash {
+		b := Builder{CacheDir: t.TempDir()}
+		a, err := b.Build(context.Background(), nil, "testdata/container/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.FailureErr(); err != nil {
+			t.Fatal(err)
+		}
+		img, err := loadImage(newTarget(name, a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg.RootFS.DiffIDs
+	}
+
+	// The zstd archive is the same layer as the uncompressed archive.
+	got := diffIDs("hello_zst.tar")
+	want := diffIDs("hello_layers.tar")
+	if len(got) != 1 || len(want) != 2 {
+		t.Fatalf("got %d and %d layers, want 1 and 2", len(got), len(want))
+	}
+	if got[0] != want[1] {
+		t.Errorf("got layer %s, want %s", got[0], want[1])
+	}
+}
+
+func TestContainerReproducible(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "1600000000")
+	const name = "testdata/container/hello_layers.tar"
+
+	build := func() (v1.Hash, string) {
+		// Start from scratch, nothing is reused between builds.
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		b := Builder{CacheDir: t.TempDir()}
+		a, err := b.Build(context.Background(), nil, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.FailureErr(); err != nil {
+			t.Fatal(err)
+		}
+		img, err := loadImage(newTarget(name, a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := time.Unix(1600000000, 0); !cfg.Created.Time.Equal(want) {
+			t.Fatalf("created got %v, want %v", cfg.Created.Time, want)
+		}
+		for _, h := range cfg.History {
+			if !h.Created.Time.Equal(cfg.Created.Time) {
+				t.Fatalf("history %q created %v", h.CreatedBy, h.Created.Time)
+			}
+		}
+		digest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, err := hashFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest, hash
+	}
+
+	digest1, hash1 := build()
+	digest2, hash2 := build()
+	if digest1 != digest2 {
+		t.Errorf("image digests differ: %s != %s", digest1, digest2)
+	}
+	if hash1 != hash2 {
+		t.Errorf("image tarballs differ: %s != %s", hash1, hash2)
+	}
+}
+
+func TestCreationTime(t *testing.T) {
+	t.Setenv("SOURCE_DATE_EPOCH", "")
+	for _, tt := range []struct {
+		in      string
+		want    time.Time
+		wantErr bool
+	}{
+		{in: "", want: time.Unix(0, 0)},
+		{in: "1600000000", want: time.Unix(1600000000, 0)},
+		{in: "2021-06-01T00:00:00Z", want: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{in: "yesterday", wantErr: true},
+	} {
+		got, err := creationTime(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%q: got error %v", tt.in, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// testRegistry starts an in-process registry, counting blob uploads and
+// manifest writes.
+func testRegistry(t *testing.T) (host string, uploads, manifests *int32) {
+	uploads, manifests = new(int32), new(int32)
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/blobs/uploads/"):
+			atomic.AddInt32(uploads, 1)
+		case r.Method == http.MethodPut && strings.Contains(r.URL.Path, "/manifests/"):
+			atomic.AddInt32(manifests, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return strings.TrimPrefix(s.URL, "http://"), uploads, manifests
+}
+
+func TestContainerPush(t *testing.T) {
+	host, uploads, manifests := testRegistry(t)
+	reference := host + "/hello:latest"
+	label := "testdata/container/hello_push?reference=" + reference
+
+	push := func() Struct {
+		b := Builder{}
+		a, err := b.Build(context.Background(), nil, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.FailureErr(); err != nil {
+			t.Fatal(err)
+		}
+		s, err := a.loadStructValue(imageConstructor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := push()
+	if atomic.LoadInt32(uploads) == 0 {
+		t.Fatal("no blobs uploaded")
+	}
+	digestRef, err := s.AttrString("reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := host + "/hello@sha256:"; !strings.HasPrefix(digestRef, want) {
+		t.Fatalf("got reference %s, want prefix %s", digestRef, want)
+	}
+	data, err := os.ReadFile("testdata/container/hello_push.digest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != digestRef {
+		t.Fatalf("digest file got %s, want %s", got, digestRef)
+	}
+
+	// Tags resolve to the pushed digest.
+	digest, err := name.NewDigest(digestRef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"latest", "v1", "stable"} {
+		ref, err := name.NewTag(host + "/hello:" + tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		desc, err := remote.Head(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := desc.Digest.String(); got != digest.DigestStr() {
+			t.Errorf("tag %s: got %s, want %s", tag, got, digest.DigestStr())
+		}
+	}
+
+	// Pushing again skips blobs and the manifest.
+	atomic.StoreInt32(uploads, 0)
+	atomic.StoreInt32(manifests, 0)
+	push()
+	if n := atomic.LoadInt32(uploads); n != 0 {
+		t.Errorf("got %d blob uploads, want 0", n)
+	}
+	if n := atomic.LoadInt32(manifests); n != 2 { // tags only
+		t.Errorf("got %d manifest writes, want 2", n)
+	}
+}
+
+func TestContainerLoad(t *testing.T) {
+	t.Run("tar", func(t *testing.T) {
+		b := Builder{}
+		a, err := b.Build(context.Background(), nil, "testdata/container/hello_load.tar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.FailureErr(); err != nil {
+			t.Fatal(err)
+		}
+		tag, err := name.NewTag("laze/hello:dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := tarball.ImageFromPath("testdata/container/hello_load.tar", &tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := loadImage(newTarget("hello.tar", a.Deps[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotDigest, err := img.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantDigest, err := want.Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotDigest != wantDigest {
+			t.Errorf("got digest %s, want %s", gotDigest, wantDigest)
+		}
+	})
+
+	t.Run("noDaemon", func(t *testing.T) {
+		t.Setenv("DOCKER_HOST", "unix://"+filepath.Join(t.TempDir(), "docker.sock"))
+
+		b := Builder{}
+		a, err := b.Build(context.Background(), nil, "testdata/container/hello_load")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = a.FailureErr()
+		if err == nil {
+			t.Fatal("expected error without a daemon")
+		}
+		for _, want := range []string{"docker daemon not available", "tar = True"} {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("error %q missing %q", err, want)
+			}
+		}
+	})
+}
+
+func TestDefaultTag(t *testing.T) {
+	for key, want := range map[string]string{
+		"testdata/container/hello.tar": "laze/hello:latest",
+		"testdata/container/Hello_OCI": "laze/hello_oci:latest",
+	} {
+		tag, err := defaultTag(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tag.String(); got != want {
+			t.Errorf("%s: got %s, want %s", key, got, want)
+		}
+	}
+}
+
+func TestContainerSign(t *testing.T) {
+	host, _, _ := testRegistry(t)
+	image := "hello_push?reference=" + host + "/hello:latest"
+	label := "testdata/container/hello_sign?image=" + url.QueryEscape(image)
+
+	data, err := os.ReadFile("testdata/container/signing.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func() []string {
+		b := Builder{}
+		a, err := b.Build(context.Background(), nil, label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.FailureErr(); err != nil {
+			t.Fatal(err)
+		}
+		s, err := a.loadStructValue(imageConstructor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reference, err := s.AttrString("reference")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := name.NewDigest(reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := s.AttrString("signature")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := host + "/hello:" + strings.Replace(ref.DigestStr(), ":", "-", 1) + ".sig"
+		if signature != want {
+			t.Fatalf("got signature %s, want %s", signature, want)
+		}
+
+		tag, err := name.NewTag(signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := remote.Image(tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := signaturePayload(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigs, err := imageSignatures(img, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, sig := range sigs {
+			data, err := base64.StdEncoding.DecodeString(sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !verifySignature(pub, payload, data) {
+				t.Errorf("invalid signature %s", sig)
+			}
+		}
+		return sigs
+	}
+
+	if sigs := sign(); len(sigs) != 1 {
+		t.Fatalf("got %d signatures, want 1", len(sigs))
+	}
+	// Signing again keeps the valid signature.
+	if sigs := sign(); len(sigs) != 1 {
+		t.Fatalf("resign got %d signatures, want 1", len(sigs))
+	}
+}
+
+func TestContainerAttest(t *testing.T) {
+	host, _, _ := testRegistry(t)
+	image := "hello_push?reference=" + host + "/hello:latest"
+
+	for _, tt := range []struct {
+		format    string
+		mediaType types.MediaType
+		want      []string
+	}{{
+		format:    "spdx",
+		mediaType: "text/spdx+json",
+		want:      []string{`"spdxVersion": "SPDX-2.2"`, `"pkg:golang/github.com/emcfarlane/laze`, `"fileName": "/usr/bin/hello"`},
+	}, {
+		format:    "cyclonedx",
+		mediaType: "application/vnd.cyclonedx+json",
+		want:      []string{`"bomFormat": "CycloneDX"`, `"pkg:golang/github.com/emcfarlane/laze`, `"name": "/usr/bin/hello"`},
+	}} {
+		t.Run(tt.format, func(t *testing.T) {
+			label := "testdata/container/hello_sbom?format=" + tt.format + "&image=" + url.QueryEscape(image)
+
+			b := Builder{}
+			a, err := b.Build(context.Background(), nil, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.FailureErr(); err != nil {
+				t.Fatal(err)
+			}
+			s, err := a.loadStructValue(imageConstructor)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sbomRef, err := s.AttrString("sbom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sbomFile, err := s.AttrString("sbom_file")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tag, err := name.NewTag(sbomRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := remote.Image(tag)
+			if err != nil {
+				t.Fatal(err)
+			}
+			layers, err := img.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(layers) != 1 {
+				t.Fatalf("got %d layers, want 1", len(layers))
+			}
+			mt, err := layers[0].MediaType()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mt != tt.mediaType {
+				t.Errorf("got media type %s, want %s", mt, tt.mediaType)
+			}
+			rc, err := layers[0].Compressed() // artifacts are uncompressed
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+			data, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			local, err := os.ReadFile(sbomFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, local) {
+				t.Error("pushed sbom differs from the sbom file")
+			}
+			if !json.Valid(data) {
+				t.Fatalf("invalid json: %s", data)
+			}
+			for _, want := range tt.want {
+				if !bytes.Contains(data, []byte(want)) {
+					t.Errorf("sbom missing %s", want)
+				}
+			}
+		})
+	}
+}
+
+// testLayer is a layer of the files, in order.
+func testLayer(t *testing.T, files ...string) v1.Layer {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		name, content := files[i], files[i+1]
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0755,
+			Size:     int64(len(content)),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return layer
+}
+
+func TestSBOMWhiteouts(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := os.ReadFile(exe) // a Go binary
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := testLayer(t,
+		"etc/keep.txt", "keep",
+		"usr/bin/tool", string(bin),
+		"var/cache/old.txt", "old",
+		"opt/app/data.txt", "data",
+	)
+	top := testLayer(t,
+		"var/cache/new.txt", "new",
+		"var/cache/.wh..wh..opq", "",
+		"usr/bin/.wh.tool", "",
+		"opt/.wh.app", "",
+	)
+
+	img, err := mutate.AppendLayers(empty.Image, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSBOM("hello", "sha256:0", time.Unix(0, 0), img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.modules) == 0 {
+		t.Fatal("missing modules of the Go binary")
+	}
+
+	// Files deleted by the top layer and their modules aren't listed.
+	if img, err = mutate.AppendLayers(img, top); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = newSBOM("hello", "sha256:0", time.Unix(0, 0), img); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range s.files {
+		names = append(names, f.name)
+	}
+	if want := []string{"/etc/keep.txt", "/var/cache/new.txt"}; fmt.Sprint(names) != fmt.Sprint(want) {
+		t.Errorf("got files %v, want %v", names, want)
+	}
+	if len(s.modules) != 0 {
+		t.Errorf("got modules %v of a deleted binary", s.modules)
+	}
+}
+
+func TestContainerPull(t *testing.T) {
+	var requests, blobs int32
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Method == http.MethodGet && strings.Contains(r.URL.Path, "/blobs/") {
+			atomic.AddInt32(&blobs, 1)
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	host := strings.TrimPrefix(s.URL, "http://")
+	reference := host + "/hello:latest"
+
+	// Push an index of random images for each platform.
+	idx := v1.ImageIndex(empty.Index)
+	imgs := make(map[string]v1.Image)
+	for _, arch := range []string{"amd64", "arm64"} {
+		img, err := random.Image(1024, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg = cfg.DeepCopy()
+		cfg.OS, cfg.Architecture = "linux", arch
+		if img, err = mutate.ConfigFile(img, cfg); err != nil {
+			t.Fatal(err)
+		}
+		imgs[arch] = img
+		idx = mutate.AppendManifests(idx, mutate.IndexAddendum{
+			Add: img,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: arch},
+			},
+		})
+	}
+	tag, err := name.NewTag(reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.WriteIndex(tag, idx); err != nil {
+		t.Fatal(err)
+	}
+	idxDigest, err := idx.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := Builder{CacheDir: t.TempDir()}
+	pull := func(query string) (*Action, error) {
+		a, err := b.Build(context.Background(), nil, "testdata/container/hello_pull.tar?"+query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a, a.FailureErr()
+	}
+	check := func(a *Action) {
+		t.Helper()
+		want, err := imgs["arm64"].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := a.loadStructValue(imageConstructor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.AttrString("digest"); err != nil || got != want.String() {
+			t.Errorf("got digest %s, want %s: %v", got, want, err)
+		}
+		img, err := loadImage(newTarget("hello_pull.tar", a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := img.ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantConfig, err := imgs["arm64"].ConfigName()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != wantConfig {
+			t.Errorf("got config %s, want %s", got, wantConfig)
+		}
+	}
+
+	query := url.Values{
+		"reference": {reference},
+		"digest":    {idxDigest.String()},
+	}.Encode()
+	a, err := pull(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(a)
+	if atomic.LoadInt32(&blobs) == 0 {
+		t.Fatal("no blobs pulled")
+	}
+
+	// Pinned pulls are verified without the registry.
+	atomic.StoreInt32(&requests, 0)
+	if a, err = pull(query); err != nil {
+		t.Fatal(err)
+	}
+	check(a)
+	if n := atomic.LoadInt32(&requests); n != 0 {
+		t.Errorf("got %d registry requests, want 0", n)
+	}
+
+	// Removed outputs are restored from the blob cache.
+	if err := os.Remove("testdata/container/hello_pull.tar"); err != nil {
+		t.Fatal(err)
+	}
+	atomic.StoreInt32(&blobs, 0)
+	if a, err = pull(query); err != nil {
+		t.Fatal(err)
+	}
+	check(a)
+	if n := atomic.LoadInt32(&blobs); n != 1 { // config only
+		t.Errorf("got %d blob requests, want 1", n)
+	}
+
+	// Tags are resolved, but up to date outputs are kept.
+	atomic.StoreInt32(&blobs, 0)
+	if a, err = pull(url.Values{"reference": {reference}}.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	check(a)
+	if n := atomic.LoadInt32(&blobs); n != 1 { // config only
+		t.Errorf("got %d blob requests, want 1", n)
+	}
+
+	// Digests of another platform are rejected.
+	amd64, err := imgs["amd64"].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pull(url.Values{
+		"reference": {reference},
+		"digest":    {amd64.String()},
+	}.Encode())
+	if err == nil || !strings.Contains(err.Error(), "want linux/arm64") {
+		t.Errorf("got error %v, want platform mismatch", err)
+	}
+}
+
+func TestParsePlatform(t *testing.T) {
+	for s, want := range map[string]*v1.Platform{
+		"linux/amd64":    {OS: "linux", Architecture: "amd64"},
+		"linux/arm64/v8": {OS: "linux", Architecture: "arm64", Variant: "v8"},
+		"linux":          nil,
+		"linux/":         nil,
+		"a/b/c/d":        nil,
+	} {
+		got, err := parsePlatform(s)
+		if want == nil {
+			if err == nil {
+				t.Errorf("%s: expected error", s)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equals(*want) {
+			t.Errorf("%s: got %v, want %v", s, got, want)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package laze
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// debControl are the fields of a Debian binary package control file.
+// https://www.debian.org/doc/debian-policy/ch-controlfields.html
+type debControl struct {
+	pkg          string
+	version      string
+	architecture string
+	maintainer   string
+	depends      []string
+	section      string
+	priority     string
+	homepage     string
+	description  string
+}
+
+// marshal formats the control file, installedSize is in bytes.
+func (c *debControl) marshal(installedSize int64) []byte {
+	var buf bytes.Buffer
+	field := func(name, value string) {
+		if value != "" {
+			fmt.Fprintf(&buf, "%s: %s\n", name, value)
+		}
+	}
+	field("Package", c.pkg)
+	field("Version", c.version)
+	field("Architecture", c.architecture)
+	field("Maintainer", c.maintainer)
+	field("Installed-Size", strconv.FormatInt((installedSize+1023)/1024, 10))
+	field("Depends", strings.Join(c.depends, ", "))
+	field("Section", c.section)
+	field("Priority", c.priority)
+	field("Homepage", c.homepage)
+
+	// The first line is the synopsis, the rest is indented with blank
+	// lines as " .".
+	lines := strings.Split(strings.TrimSpace(c.description), "\n")
+	field("Description", strings.TrimSpace(lines[0]))
+	for _, line := range lines[1:] {
+		line = strings.TrimRight(line, " \t")
+		if line == "" {
+			line = "."
+		}
+		buf.WriteString(" " + line + "\n")
+	}
+	return buf.Bytes()
+}
+
+// deb creates a Debian binary package of the files.
+func (p *packaging) deb(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name      string
+		control   = debControl{architecture: "all"}
+		depends   *starlark.List
+		conffiles *starlark.List
+		attrs     tarAttrs
+	)
+	if err := starlark.UnpackArgs(
+		"deb", args, kwargs,
+		append([]interface{}{
+			"name", &name,
+			"package", &control.pkg,
+			"version", &control.version,
+			"maintainer", &control.maintainer,
+			"description", &control.description,
+			"architecture?", &control.architecture,
+			"depends?", &depends,
+			"section?", &control.section,
+			"priority?", &control.priority,
+			"homepage?", &control.homepage,
+			"conffiles?", &conffiles,
+		}, attrs.pairs()...)...,
+	); err != nil {
+		return nil, err
+	}
+	var err error
+	if control.depends, err = listToStrings(depends); err != nil {
+		return nil, fmt.Errorf("depends: %w", err)
+	}
+	confs, err := listToStrings(conffiles)
+	if err != nil {
+		return nil, fmt.Errorf("conffiles: %w", err)
+	}
+	if strings.TrimSpace(control.description) == "" {
+		return nil, fmt.Errorf("deb: missing description")
+	}
+	data, err := attrs.newBuilder()
+	if err != nil {
+		return nil, err
+	}
+	data.prefix = "./"
+
+	filename := p.out
+	if p.record(&command{
+		Name:    "packaging.deb",
+		Args:    []string{"package=" + control.pkg, "version=" + control.version},
+		Outputs: []string{filename},
+	}) {
+		return newPlannedFile(filename)
+	}
+
+	if err := attrs.addEntries(data, path.Dir(p.key)); err != nil {
+		return nil, err
+	}
+	if err := data.addParents(); err != nil {
+		return nil, err
+	}
+	if err := writeDeb(filename, &control, confs, data); err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newFile(filename, fi)
+}
+
+// writeDeb writes the package of the data archive to filename.
+func writeDeb(filename string, control *debControl, conffiles []string, data *tarBuilder) error {
+	keys, err := data.keys()
+	if err != nil {
+		return err
+	}
+
+	// Checksums and size of the regular files.
+	var (
+		size    int64
+		md5sums bytes.Buffer
+	)
+	for _, key := range keys {
+		e := data.entries[key]
+		if e.hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		h := md5.New()
+		if err := copyEntry(h, e); err != nil {
+			return err
+		}
+		fmt.Fprintf(&md5sums, "%x  %s\n", h.Sum(nil), key)
+		size += e.hdr.Size
+	}
+
+	var confs bytes.Buffer
+	for _, conf := range conffiles {
+		key := tarName(conf)
+		if e, ok := data.entries[key]; !ok || e.hdr.Typeflag != tar.TypeReg {
+			return fmt.Errorf("conffiles: no file %q", conf)
+		}
+		confs.WriteString("/" + key + "\n")
+	}
+
+	ctrl := &tarBuilder{modTime: data.modTime, prefix: "./"}
+	if err := ctrl.addData("control", control.marshal(size), 0644); err != nil {
+		return err
+	}
+	if err := ctrl.addData("md5sums", md5sums.Bytes(), 0644); err != nil {
+		return err
+	}
+	if confs.Len() > 0 {
+		if err := ctrl.addData("conffiles", confs.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	ctrlTar, err := gzipTar(ctrl)
+	if err != nil {
+		return err
+	}
+	dataTar, err := gzipTar(data)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(path.Dir(filename), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	aw := newArWriter(f, data.modTime)
+	for _, m := range []struct {
+		name string
+		data []byte
+	}{
+		{"debian-binary", []byte("2.0\n")},
+		{"control.tar.gz", ctrlTar},
+		{"data.tar.gz", dataTar},
+	} {
+		if err := aw.add(m.name, m.data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// gzipTar returns the gzipped archive.
+func gzipTar(t *tarBuilder) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := t.write(zw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// arWriter writes the common ar format of Debian packages.
+type arWriter struct {
+	w       io.Writer
+	modTime time.Time
+	started bool
+}
+
+func newArWriter(w io.Writer, modTime time.Time) *arWriter {
+	return &arWriter{w: w, modTime: modTime}
+}
+
+// add writes a member, members are padded to an even size.
+func (a *arWriter) add(name string, data []byte) error {
+	if !a.started {
+		if _, err := io.WriteString(a.w, "!<arch>\n"); err != nil {
+			return err
+		}
+		a.started = true
+	}
+	if len(name) > 16 {
+		return fmt.Errorf("ar: name too long %q", name)
+	}
+	hdr := fmt.Sprintf("%-16s%-12d%-6d%-6d%-8s%-10d`\n",
+		name, a.modTime.Unix(), 0, 0, "100644", len(data),
+	)
+	if _, err := io.WriteString(a.w, hdr); err != nil {
+		return err
+	}
+	if _, err := a.w.Write(data); err != nil {
+		return err
+	}
+	if len(data)%2 != 0 {
+		if _, err := io.WriteString(a.w, "\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
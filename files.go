@@ -15,7 +15,15 @@ import (
 const fileConstructor starlark.String = "file"
 
 func newFile(key string, fi fs.FileInfo) (*starlarkstruct.Struct, error) {
-	name := fi.Name()
+	return newFileValue(key, fi.Name(), fi.IsDir(), fi.Size())
+}
+
+// newPlannedFile is a file that will be created by an action.
+func newPlannedFile(key string) (*starlarkstruct.Struct, error) {
+	return newFileValue(key, path.Base(key), false, 0)
+}
+
+func newFileValue(key, name string, isDir bool, size int64) (*starlarkstruct.Struct, error) {
 	dir := path.Dir(key)
 	ospath, err := filepath.Abs(filepath.FromSlash(key))
 	if err != nil {
@@ -26,9 +34,9 @@ func newFile(key string, fi fs.FileInfo) (*starlarkstruct.Struct, error) {
 		"dirname":      starlark.String(filepath.FromSlash(dir)),
 		"extension":    starlark.String(path.Ext(name)),
 		"path":         starlark.String(ospath),
-		"is_directory": starlark.Bool(fi.IsDir()),
+		"is_directory": starlark.Bool(isDir),
 		//"is_source":    starlark.Bool(isSource),
-		"size": starlark.MakeInt64(fi.Size()),
+		"size": starlark.MakeInt64(size),
 	}), nil
 }
 
@@ -62,6 +70,10 @@ func (f *files) stat(thread *starlark.Thread, b *starlark.Builtin, args starlark
 
 	fi, err := os.Stat(name)
 	if err != nil {
+		// Outputs of a dry run don't exist.
+		if f.builder.DryRun && os.IsNotExist(err) {
+			return newPlannedFile(name)
+		}
 		return nil, err
 	}
 	return newFile(name, fi)
@@ -82,6 +94,13 @@ func (f *files) write(thread *starlark.Thread, b *starlark.Builtin, args starlar
 		return nil, err
 	}
 
+	if f.record(&command{
+		Name:    "files.write",
+		Outputs: []string{name},
+	}) {
+		return newPlannedFile(name)
+	}
+
 	if err := os.WriteFile(name, []byte(content), os.FileMode(mode)); err != nil {
 		return nil, err
 	}
@@ -111,6 +130,9 @@ func (f *files) declare(thread *starlark.Thread, b *starlark.Builtin, args starl
 		return nil, err
 	}
 	dir := path.Dir(name)
+	if f.builder.DryRun {
+		return starlark.String(name), nil
+	}
 
 	// Create the directory structure if it doesn't exist.
 	if err := os.MkdirAll(dir, 0777); err != nil {
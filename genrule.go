@@ -0,0 +1,268 @@
+package laze
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// genruleInfoConstructor is the genrule_info provider, the files of a
+// genrule with more than one output.
+const genruleInfoConstructor starlark.String = "genrule_info"
+
+// targetFiles returns the paths of the files of a target: a file or a
+// provider with a list of files, like protoc_info.
+func targetFiles(t *target) ([]string, error) {
+	s, ok := t.action.Value.(*starlarkstruct.Struct)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want files", t.label, t.action.Value.Type())
+	}
+	if s.Constructor() == fileConstructor {
+		name, err := Struct{s}.AttrString("path")
+		if err != nil {
+			return nil, err
+		}
+		return []string{name}, nil
+	}
+	x, err := s.Attr("files")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s has no files", t.label, s.Constructor())
+	}
+	l, ok := x.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("%s: files not a list", t.label)
+	}
+	names := make([]string, l.Len())
+	for i := range names {
+		f, ok := l.Index(i).(*starlarkstruct.Struct)
+		if !ok || f.Constructor() != fileConstructor {
+			return nil, fmt.Errorf("%s: got %s, want file", t.label, l.Index(i).Type())
+		}
+		if names[i], err = (Struct{f}).AttrString("path"); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// makeVars expands the make variables of genrule commands.
+type makeVars struct {
+	dir     string              // package dir, labels are relative to it
+	targets map[string][]string // action key -> files of srcs and tools
+	srcs    []string
+	outs    []string
+	outDir  string // $(@D)
+}
+
+// location returns the files of a label of the srcs or tools.
+func (m *makeVars) location(label string) ([]string, error) {
+	u, err := parseLabel(label, m.dir)
+	if err != nil {
+		return nil, err
+	}
+	names, ok := m.targets[u.Path]
+	if !ok {
+		return nil, fmt.Errorf("label %s isn't in srcs or tools", label)
+	}
+	return names, nil
+}
+
+// expand replaces $(location label), $(locations label), $(SRCS), $(OUTS)
+// and $(@D) in the cmd with the quoted paths, "$$" is a literal "$".
+func (m *makeVars) expand(cmd string) (string, error) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(cmd, '$')
+		if i < 0 || i == len(cmd)-1 {
+			b.WriteString(cmd)
+			return b.String(), nil
+		}
+		b.WriteString(cmd[:i])
+		cmd = cmd[i+1:]
+
+		switch cmd[0] {
+		case '$':
+			b.WriteByte('$')
+			cmd = cmd[1:]
+			continue
+		case '(':
+		default:
+			// Shell variables like $1 or ${x} are left as is.
+			b.WriteByte('$')
+			continue
+		}
+
+		end := strings.IndexByte(cmd, ')')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated $(%s", cmd[1:])
+		}
+		name := strings.TrimSpace(cmd[1:end])
+		cmd = cmd[end+1:]
+
+		fields := strings.Fields(name)
+		switch {
+		case name == "SRCS":
+			b.WriteString(shellQuote(m.srcs...))
+		case name == "OUTS":
+			b.WriteString(shellQuote(m.outs...))
+		case name == "@D":
+			b.WriteString(shellQuote(m.outDir))
+		case len(fields) == 2 && fields[0] == "location":
+			names, err := m.location(fields[1])
+			if err != nil {
+				return "", err
+			}
+			if len(names) != 1 {
+				return "", fmt.Errorf("$(location %s) has %d files, use $(locations)", fields[1], len(names))
+			}
+			b.WriteString(shellQuote(names[0]))
+		case len(fields) == 2 && fields[0] == "locations":
+			names, err := m.location(fields[1])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(shellQuote(names...))
+		default:
+			return "", fmt.Errorf("unknown make variable $(%s)", name)
+		}
+	}
+}
+
+// genrule runs the cmd with sh in the package dir. Outs are paths relative
+// to the output dir of the package. A single out is returned as a file,
+// more as the genrule_info provider of the files.
+func (a *actions) genrule(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name      string
+		cmdString string
+		outsList  *starlark.List
+		srcsList  *starlark.List
+		toolsList *starlark.List
+	)
+	if err := starlark.UnpackArgs(
+		"genrule", args, kwargs,
+		"name", &name,
+		"cmd", &cmdString,
+		"outs", &outsList,
+		"srcs?", &srcsList,
+		"tools?", &toolsList,
+	); err != nil {
+		return nil, err
+	}
+
+	dir := path.Dir(a.key)
+	outDir := a.action.outDir()
+	absOutDir, err := filepath.Abs(filepath.FromSlash(outDir))
+	if err != nil {
+		return nil, err
+	}
+	m := &makeVars{
+		dir:     dir,
+		targets: make(map[string][]string),
+		outDir:  absOutDir,
+	}
+
+	for _, l := range []*starlark.List{srcsList, toolsList} {
+		if l == nil {
+			continue
+		}
+		for i := 0; i < l.Len(); i++ {
+			t, ok := l.Index(i).(*target)
+			if !ok {
+				return nil, fmt.Errorf("genrule: got %s, want target", l.Index(i).Type())
+			}
+			names, err := targetFiles(t)
+			if err != nil {
+				return nil, err
+			}
+			m.targets[t.action.Key] = names
+			if l == srcsList {
+				m.srcs = append(m.srcs, names...)
+			}
+		}
+	}
+
+	outNames, err := listToStrings(outsList)
+	if err != nil {
+		return nil, fmt.Errorf("outs: %w", err)
+	}
+	if len(outNames) == 0 {
+		return nil, fmt.Errorf("genrule: no outs")
+	}
+	outputs := make([]string, len(outNames))
+	for i, out := range outNames {
+		if out == "" || path.IsAbs(out) || out != path.Clean(out) || strings.HasPrefix(out, "../") {
+			return nil, fmt.Errorf("outs: invalid out %q", out)
+		}
+		outputs[i] = path.Join(outDir, out)
+		abs, err := filepath.Abs(filepath.FromSlash(outputs[i]))
+		if err != nil {
+			return nil, err
+		}
+		m.outs = append(m.outs, abs)
+	}
+	// Like bazel, $(@D) of a single out is its dir.
+	if len(m.outs) == 1 {
+		m.outDir = filepath.Dir(m.outs[0])
+	}
+
+	script, err := m.expand(cmdString)
+	if err != nil {
+		return nil, fmt.Errorf("cmd: %w", err)
+	}
+
+	cmd := &command{
+		Name:    "sh",
+		Args:    []string{"-c", script},
+		Dir:     dir,
+		Outputs: outputs,
+	}
+	if a.record(cmd) {
+		elems := make([]starlark.Value, len(outputs))
+		for i, output := range outputs {
+			f, err := newPlannedFile(output)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = f
+		}
+		return genruleValue(elems), nil
+	}
+
+	for _, out := range m.outs {
+		if err := os.MkdirAll(filepath.Dir(out), 0777); err != nil {
+			return nil, err
+		}
+	}
+	if err := a.exec(cmd, nil); err != nil {
+		return nil, err
+	}
+
+	elems := make([]starlark.Value, len(outputs))
+	for i, output := range outputs {
+		fi, err := os.Stat(output)
+		if err != nil {
+			return nil, fmt.Errorf("genrule: declared output %s wasn't generated", output)
+		}
+		f, err := newFile(output, fi)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = f
+	}
+	return genruleValue(elems), nil
+}
+
+func genruleValue(files []starlark.Value) starlark.Value {
+	if len(files) == 1 {
+		return files[0]
+	}
+	return starlarkstruct.FromStringDict(genruleInfoConstructor, starlark.StringDict{
+		"files": starlark.NewList(files),
+	})
+}
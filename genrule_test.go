@@ -0,0 +1,101 @@
+package laze
+
+import (
+	"context"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestGenrule(t *testing.T) {
+	for _, tt := range []struct {
+		label string
+		file  string
+		want  string
+	}{
+		{"testdata/merge/sh", "testdata/merge/text.txt", "Hello,\n world!\n"},
+		{"testdata/merge/upper", "testdata/merge/upper.txt", "HELLO,\n WORLD!\n"},
+		{"testdata/merge/count", "testdata/merge/count.txt", "2\n"},
+	} {
+		t.Run(tt.label, func(t *testing.T) {
+			a, err := (&Builder{}).Build(context.Background(), nil, tt.label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.FailureErr(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := a.loadStructValue(fileConstructor); err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(data); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	info := buildStruct(t, &Builder{}, "testdata/merge/split", genruleInfoConstructor)
+	names, err := targetFiles(&target{label: "split", action: &Action{Value: info}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		want := []string{"intro.txt", "body.txt"}[i]
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, err := ioutil.ReadFile("testdata/merge/" + want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(data, src) {
+			t.Errorf("%s: got %q, want %q", name, data, src)
+		}
+	}
+}
+
+func TestGenruleExpand(t *testing.T) {
+	m := &makeVars{
+		dir: "pkg",
+		targets: map[string][]string{
+			"pkg/a.txt": {"/ws/pkg/a.txt"},
+			"pkg/tool":  {"/ws/pkg/tool"},
+			"other/gen": {"/ws/other/x.txt", "/ws/other/y z.txt"},
+			"pkg/b.txt": {"/ws/pkg/b.txt"},
+		},
+		srcs:   []string{"/ws/pkg/a.txt", "/ws/pkg/b.txt"},
+		outs:   []string{"/ws/pkg/out.txt"},
+		outDir: "/ws/pkg",
+	}
+	for _, tt := range []struct {
+		cmd, want, err string
+	}{
+		{cmd: "$(location tool) $(OUTS) $(SRCS)", want: "/ws/pkg/tool /ws/pkg/out.txt /ws/pkg/a.txt /ws/pkg/b.txt"},
+		{cmd: "cat $(locations ../other/gen) > $(@D)/c", want: "cat /ws/other/x.txt '/ws/other/y z.txt' > /ws/pkg/c"},
+		{cmd: "echo $$HOME ${x} $1 $", want: "echo $HOME ${x} $1 $"},
+		{cmd: "$(location ../other/gen)", err: "$(location ../other/gen) has 2 files, use $(locations)"},
+		{cmd: "$(location missing)", err: "label missing isn't in srcs or tools"},
+		{cmd: "$(CC) -o x", err: "unknown make variable $(CC)"},
+		{cmd: "$(SRCS", err: "unterminated $(SRCS"},
+	} {
+		got, err := m.expand(tt.cmd)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %q", tt.cmd, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.cmd, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.cmd, got, tt.want)
+		}
+	}
+}
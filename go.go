@@ -0,0 +1,462 @@
+package laze
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// goInfoConstructor is the go_info provider, a Go package and what it's
+// built from.
+const goInfoConstructor starlark.String = "go_info"
+
+// Modes of go.build.
+const (
+	goModeBinary  = "binary"
+	goModeLibrary = "library"
+	goModeTest    = "test"
+)
+
+type goActions struct {
+	*actions
+}
+
+func newGoModule(a *actions) *starlarkstruct.Module {
+	g := goActions{a}
+	return &starlarkstruct.Module{
+		Name: "go",
+		Members: starlark.StringDict{
+			"build":     starlark.NewBuiltin("go.build", g.build),
+			"toolchain": starlark.NewBuiltin("go.toolchain", g.toolchain),
+		},
+	}
+}
+
+// goPackage is the output of go list -json.
+type goPackage struct {
+	Dir        string
+	ImportPath string
+	Name       string
+	Standard   bool
+	ForTest    string
+	Module     *struct {
+		Path    string
+		Version string
+		Main    bool
+		GoMod   string
+	}
+	Error *struct {
+		Err string
+	}
+
+	GoFiles      []string
+	CgoFiles     []string
+	CFiles       []string
+	CXXFiles     []string
+	HFiles       []string
+	SFiles       []string
+	SysoFiles    []string
+	EmbedFiles   []string
+	TestGoFiles  []string
+	XTestGoFiles []string
+}
+
+// sourceFiles returns the names of the files of the package in its dir.
+func (p *goPackage) sourceFiles(test bool) []string {
+	var names []string
+	for _, files := range [][]string{
+		p.GoFiles, p.CgoFiles, p.CFiles, p.CXXFiles, p.HFiles, p.SFiles,
+		p.SysoFiles, p.EmbedFiles,
+	} {
+		names = append(names, files...)
+	}
+	if test {
+		names = append(names, p.TestGoFiles...)
+		names = append(names, p.XTestGoFiles...)
+	}
+	return names
+}
+
+// goList runs the go list command. It returns the package of the command
+// dir and every listed package.
+func (g *goActions) goList(cmd *command) (*goPackage, []*goPackage, error) {
+	var stdout bytes.Buffer
+	if err := g.exec(cmd, &stdout); err != nil {
+		return nil, nil, err
+	}
+	dir, err := filepath.Abs(cmd.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		root *goPackage
+		pkgs []*goPackage
+	)
+	dec := json.NewDecoder(&stdout)
+	for {
+		var p goPackage
+		if err := dec.Decode(&p); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("go list: %w", err)
+		}
+		if p.Error != nil {
+			return nil, nil, fmt.Errorf("go list: %s: %s", p.ImportPath, p.Error.Err)
+		}
+		if p.Dir == dir && p.ForTest == "" && !strings.HasSuffix(p.ImportPath, ".test") {
+			root = &p
+		}
+		pkgs = append(pkgs, &p)
+	}
+	if root == nil {
+		return nil, nil, fmt.Errorf("go list: no package in %s", cmd.Dir)
+	}
+	return root, pkgs, nil
+}
+
+// goInfo creates the go_info provider of the package and returns the files
+// it's built from, relative to the workspace: the files of the packages of
+// the main module and its go.mod and go.sum.
+func (g *goActions) goInfo(root *goPackage, pkgs []*goPackage, test bool, buildInfo string) (starlark.Value, []string, error) {
+	ws, err := filepath.Abs(g.builder.Dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	rel := func(name string) (string, bool) {
+		r, err := filepath.Rel(ws, name)
+		if err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+			return "", false // generated files of the build cache
+		}
+		return filepath.ToSlash(r), true
+	}
+
+	var (
+		inputs  = make(map[string]bool)
+		imports = make(map[string]bool)
+		modules = make(map[string]bool)
+		files   []string
+	)
+	for _, p := range pkgs {
+		if p.Standard {
+			continue
+		}
+		if p != root && p.ForTest == "" && !strings.HasSuffix(p.ImportPath, ".test") {
+			imports[p.ImportPath] = true
+		}
+		m := p.Module
+		if m == nil {
+			continue
+		}
+		if !m.Main {
+			modules[m.Path+"@"+m.Version] = true
+			continue
+		}
+		for _, name := range p.sourceFiles(test) {
+			if r, ok := rel(filepath.Join(p.Dir, name)); ok {
+				inputs[r] = true
+			}
+		}
+		if m.GoMod != "" {
+			for _, name := range []string{m.GoMod, strings.TrimSuffix(m.GoMod, ".mod") + ".sum"} {
+				if _, err := os.Stat(name); err != nil {
+					continue
+				}
+				if r, ok := rel(name); ok {
+					inputs[r] = true
+				}
+			}
+		}
+	}
+	for _, name := range root.sourceFiles(test) {
+		if r, ok := rel(filepath.Join(root.Dir, name)); ok {
+			files = append(files, r)
+		}
+	}
+
+	info := starlarkstruct.FromStringDict(goInfoConstructor, starlark.StringDict{
+		"import_path": starlark.String(root.ImportPath),
+		"package":     starlark.String(root.Name),
+		"files":       stringsList(files),
+		"imports":     stringsList(sortedKeys(imports)),
+		"modules":     stringsList(sortedKeys(modules)),
+		"build_info":  starlark.String(buildInfo),
+	})
+	return info, sortedKeys(inputs), nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func stringsList(ss []string) *starlark.List {
+	elems := make([]starlark.Value, len(ss))
+	for i, s := range ss {
+		elems[i] = starlark.String(s)
+	}
+	return starlark.NewList(elems)
+}
+
+// xDefFlags returns the -X linker flags of the x_defs, with {KEY} replaced
+// by the workspace status, "" unless stamping. Values with keys stamp the
+// action.
+func (g *goActions) xDefFlags(xDefs *starlark.Dict) ([]string, error) {
+	if xDefs == nil {
+		return nil, nil
+	}
+	defs := make(map[string]string, xDefs.Len())
+	names := make([]string, 0, xDefs.Len())
+	for _, item := range xDefs.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			return nil, fmt.Errorf("invalid name %s", item[0])
+		}
+		value, ok := starlark.AsString(item[1])
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid value %s", name, item[1])
+		}
+		if strings.Contains(value, "{") {
+			value = expandStamp(value, g.builder.stampAction(g.action))
+		}
+		defs[name] = value
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	flags := make([]string, 0, len(names))
+	for _, name := range names {
+		flag := name + "=" + defs[name]
+		if strings.ContainsAny(flag, " \t'\"") {
+			// Go splits ldflags on spaces, outside of quotes.
+			q := "'"
+			if strings.Contains(flag, "'") {
+				q = `"`
+			}
+			flag = q + flag + q
+		}
+		flags = append(flags, "-X", flag)
+	}
+	return flags, nil
+}
+
+// checkGoSrcs checks the generated srcs of a package are Go files of its
+// dir. Srcs are files or providers of generated files, like protoc_info.
+func checkGoSrcs(dir string, srcs *starlark.List) error {
+	if srcs == nil {
+		return nil
+	}
+	absDir, err := filepath.Abs(filepath.FromSlash(dir))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < srcs.Len(); i++ {
+		t, ok := srcs.Index(i).(*target)
+		if !ok {
+			return fmt.Errorf("srcs: got %s, want target", srcs.Index(i).Type())
+		}
+		names, err := targetFiles(t)
+		if err != nil {
+			return fmt.Errorf("srcs: %w", err)
+		}
+		for _, name := range names {
+			if filepath.Ext(name) != ".go" {
+				continue // other generated files, like descriptors
+			}
+			if filepath.Dir(name) != absDir {
+				return fmt.Errorf("srcs: %s isn't in the package dir %s", name, dir)
+			}
+		}
+	}
+	return nil
+}
+
+// build compiles the Go package of the rule's dir. Binaries and tests
+// return their file with the go_info provider as the "go" attr, libraries
+// return the go_info provider.
+func (g *goActions) build(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name     string
+		mode     = goModeBinary
+		goos     string
+		goarch   string
+		cgo      bool
+		envList  *starlark.List
+		ldflags  *starlark.List
+		tagsList *starlark.List
+		xDefs    *starlark.Dict
+		srcsList *starlark.List
+		trimpath = true
+	)
+	if err := starlark.UnpackArgs(
+		"go.build", args, kwargs,
+		"name", &name,
+		"mode?", &mode,
+		"goos?", &goos,
+		"goarch?", &goarch,
+		"cgo?", &cgo,
+		"env?", &envList,
+		"ldflags?", &ldflags,
+		"tags?", &tagsList,
+		"x_defs?", &xDefs,
+		"srcs?", &srcsList,
+		"trimpath?", &trimpath,
+	); err != nil {
+		return nil, err
+	}
+	switch mode {
+	case goModeBinary, goModeLibrary, goModeTest:
+	default:
+		return nil, fmt.Errorf("go.build: invalid mode %q", mode)
+	}
+	test := mode == goModeTest
+
+	extraEnv, err := listToStrings(envList)
+	if err != nil {
+		return nil, fmt.Errorf("env: %w", err)
+	}
+	var env []string
+	if goos != "" {
+		env = append(env, "GOOS="+goos)
+	}
+	if goarch != "" {
+		env = append(env, "GOARCH="+goarch)
+	}
+	if cgo {
+		// The C toolchain is picked by the target, env may override it.
+		t, err := g.builder.goToolchain(goos, goarch)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, "CGO_ENABLED=1")
+		env = append(env, t.env()...)
+	} else {
+		env = append(env, "CGO_ENABLED=0")
+	}
+	env = append(env, extraEnv...)
+	flags, err := listToStrings(ldflags)
+	if err != nil {
+		return nil, fmt.Errorf("ldflags: %w", err)
+	}
+	tags, err := listToStrings(tagsList)
+	if err != nil {
+		return nil, fmt.Errorf("tags: %w", err)
+	}
+	xFlags, err := g.xDefFlags(xDefs)
+	if err != nil {
+		return nil, fmt.Errorf("x_defs: %w", err)
+	}
+	flags = append(flags, xFlags...)
+
+	dir := path.Dir(g.key)
+	if err := checkGoSrcs(dir, srcsList); err != nil {
+		return nil, err
+	}
+	listArgs := []string{"list", "-json", "-deps"}
+	if test {
+		listArgs = append(listArgs, "-test")
+	}
+	var buildArgs []string
+	switch mode {
+	case goModeBinary, goModeLibrary:
+		buildArgs = []string{"build"}
+	case goModeTest:
+		buildArgs = []string{"test", "-c"}
+	}
+	if trimpath {
+		buildArgs = append(buildArgs, "-trimpath")
+	}
+	if len(tags) > 0 {
+		listArgs = append(listArgs, "-tags", strings.Join(tags, ","))
+		buildArgs = append(buildArgs, "-tags", strings.Join(tags, ","))
+	}
+	if len(flags) > 0 {
+		buildArgs = append(buildArgs, "-ldflags", strings.Join(flags, " "))
+	}
+
+	var out string
+	if mode != goModeLibrary {
+		if out, err = filepath.Abs(filepath.FromSlash(g.out)); err != nil {
+			return nil, err
+		}
+		buildArgs = append(buildArgs, "-o", out)
+	}
+	listCmd := &command{Name: "go", Args: append(listArgs, "."), Env: env, Dir: dir}
+	buildCmd := &command{Name: "go", Args: append(buildArgs, "."), Env: env, Dir: dir}
+	if out != "" {
+		buildCmd.Outputs = []string{g.out}
+	}
+
+	dryRun := g.record(listCmd)
+	dryRun = g.record(buildCmd) || dryRun
+	if dryRun {
+		info := starlarkstruct.FromStringDict(goInfoConstructor, starlark.StringDict{})
+		if mode == goModeLibrary {
+			return info, nil
+		}
+		f, err := newPlannedFile(g.out)
+		if err != nil {
+			return nil, err
+		}
+		return withAttrs(f, starlark.StringDict{"go": info}), nil
+	}
+
+	root, pkgs, err := g.goList(listCmd)
+	if err != nil {
+		return nil, err
+	}
+	if test && len(root.TestGoFiles)+len(root.XTestGoFiles) == 0 {
+		return nil, fmt.Errorf("go.build: %s has no test files", root.ImportPath)
+	}
+	if out != "" {
+		if err := os.MkdirAll(filepath.Dir(out), 0777); err != nil {
+			return nil, err
+		}
+	}
+	if err := g.exec(buildCmd, nil); err != nil {
+		return nil, err
+	}
+
+	var buildInfo string
+	if out != "" {
+		bi, err := buildinfo.ReadFile(out)
+		if err != nil {
+			return nil, err
+		}
+		buildInfo = bi.String()
+	}
+	info, inputs, err := g.goInfo(root, pkgs, test, buildInfo)
+	if err != nil {
+		return nil, err
+	}
+	if g.action != nil {
+		g.action.inputs = inputs
+	}
+	if mode == goModeLibrary {
+		return info, nil
+	}
+
+	fi, err := os.Stat(out)
+	if err != nil {
+		return nil, err
+	}
+	f, err := newFile(g.out, fi)
+	if err != nil {
+		return nil, err
+	}
+	return withAttrs(f, starlark.StringDict{"go": info}), nil
+}
@@ -1,18 +1,35 @@
 module github.com/emcfarlane/laze
 
-go 1.16
+go 1.20
 
 require (
 	github.com/containerd/stargz-snapshotter/estargz v0.7.0
+	github.com/docker/docker v20.10.7+incompatible
+	github.com/emcfarlane/starlarkassert v0.0.0-20210612114505-0b5ce3fc3821
+	github.com/google/go-containerregistry v0.5.1
+	github.com/klauspost/compress v1.13.1
+	github.com/ulikunitz/xz v0.5.10
+	go.starlark.net v0.0.0-20210602144842-1cdb82c9e17a
+)
+
+require (
+	github.com/containerd/containerd v1.3.0 // indirect
 	github.com/docker/cli v20.10.7+incompatible // indirect
-	github.com/docker/docker v20.10.7+incompatible // indirect
+	github.com/docker/distribution v2.7.1+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.6.4 // indirect
-	github.com/emcfarlane/starlarkassert v0.0.0-20210612114505-0b5ce3fc3821
+	github.com/docker/go-connections v0.4.0 // indirect
+	github.com/docker/go-units v0.4.0 // indirect
+	github.com/gogo/protobuf v1.3.1 // indirect
+	github.com/golang/protobuf v1.4.1 // indirect
 	github.com/golang/snappy v0.0.4 // indirect
-	github.com/google/go-containerregistry v0.5.1
-	github.com/klauspost/compress v1.13.1 // indirect
+	github.com/opencontainers/go-digest v1.0.0 // indirect
+	github.com/opencontainers/image-spec v1.0.1 // indirect
+	github.com/pkg/errors v0.9.1 // indirect
 	github.com/sirupsen/logrus v1.8.1 // indirect
-	go.starlark.net v0.0.0-20210602144842-1cdb82c9e17a
+	golang.org/x/net v0.0.0-20201110031124-69a78807bb2b // indirect
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c // indirect
 	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
+	google.golang.org/genproto v0.0.0-20200527145253-8367513e4ece // indirect
+	google.golang.org/grpc v1.29.1 // indirect
+	google.golang.org/protobuf v1.25.0 // indirect
 )
@@ -0,0 +1,238 @@
+package laze
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// buildGoInfo builds the label and returns its go_info and file path, empty for
+// libraries.
+func buildGoInfo(t *testing.T, b *Builder, label string) (*starlarkstruct.Struct, string) {
+	t.Helper()
+	a, err := b.Build(context.Background(), nil, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+	v, ok := a.Value.(*starlarkstruct.Struct)
+	if !ok {
+		t.Fatalf("got %s, want struct", a.Value.Type())
+	}
+	if v.Constructor() == goInfoConstructor {
+		return v, ""
+	}
+	filename, err := Struct{v}.AttrString("path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, err := v.Attr("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.(*starlarkstruct.Struct), filename
+}
+
+func structString(t *testing.T, s *starlarkstruct.Struct, name string) string {
+	t.Helper()
+	v, err := Struct{s}.AttrString(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func structStrings(t *testing.T, s *starlarkstruct.Struct, name string) []string {
+	t.Helper()
+	x, err := s.Attr(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := listToStrings(x.(*starlark.List))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ss
+}
+
+func TestGoBinary(t *testing.T) {
+	b := &Builder{CacheDir: t.TempDir()}
+	info, filename := buildGoInfo(t, b, "testdata/go/hello_x")
+
+	out, err := exec.Command(filename).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "Hello, laze!\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if got := structString(t, info, "import_path"); got != "github.com/emcfarlane/laze/testdata/go" {
+		t.Errorf("import_path: %s", got)
+	}
+	if got, want := structStrings(t, info, "files"), []string{"testdata/go/main.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files: %v, want %v", got, want)
+	}
+	if got, want := structStrings(t, info, "imports"), []string{"github.com/emcfarlane/laze/testdata/go/greet"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("imports: %v, want %v", got, want)
+	}
+	buildInfo := structString(t, info, "build_info")
+	for _, want := range []string{
+		"path\tgithub.com/emcfarlane/laze/testdata/go",
+		"build\t-trimpath=true",
+	} {
+		if !strings.Contains(buildInfo, want) {
+			t.Errorf("missing %q in build info:\n%s", want, buildInfo)
+		}
+	}
+
+	// The record has the files of the package and its local imports.
+	a := b.actionCache["file://testdata/go/hello_x"]
+	rec, err := b.loadRecord(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"go.mod",
+		"go.sum",
+		"testdata/go/greet/greet.go",
+		"testdata/go/main.go",
+	}
+	if got := rec.inputNames(); !reflect.DeepEqual(got, want) {
+		t.Errorf("inputs: %v, want %v", got, want)
+	}
+
+	// Queries report the inputs of the last build.
+	actions, err := b.Query(context.Background(), "testdata/go/hello_x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions[0].inputs; !reflect.DeepEqual(got, want) {
+		t.Errorf("query inputs: %v, want %v", got, want)
+	}
+}
+
+func TestGoLibrary(t *testing.T) {
+	info, filename := buildGoInfo(t, &Builder{}, "testdata/go/greet/greet")
+	if filename != "" {
+		t.Errorf("library has file %s", filename)
+	}
+	for name, want := range map[string]string{
+		"import_path": "github.com/emcfarlane/laze/testdata/go/greet",
+		"package":     "greet",
+		"build_info":  "",
+	} {
+		if got := structString(t, info, name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	if got, want := structStrings(t, info, "files"), []string{"testdata/go/greet/greet.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files: %v, want %v", got, want)
+	}
+}
+
+func TestGoTest(t *testing.T) {
+	info, filename := buildGoInfo(t, &Builder{}, "testdata/go/greet/greet_test")
+	want := []string{"testdata/go/greet/greet.go", "testdata/go/greet/greet_test.go"}
+	if got := structStrings(t, info, "files"); !reflect.DeepEqual(got, want) {
+		t.Errorf("files: %v, want %v", got, want)
+	}
+
+	out, err := exec.Command(filename, "-test.v").CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if !strings.Contains(string(out), "--- PASS: TestHello") {
+		t.Errorf("unexpected output: %s", out)
+	}
+}
+
+func TestGoExplainInputs(t *testing.T) {
+	b := &Builder{CacheDir: t.TempDir()}
+	buildGoInfo(t, b, "testdata/go/greet/greet")
+
+	// Inputs of the previous record are hashed before running.
+	a := b.actionCache["file://testdata/go/greet/greet"]
+	old, err := b.loadRecord(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.ID = "stale"
+	old.Inputs["testdata/go/greet/greet.go"] = "changed"
+	a.rec = old
+	if err := b.saveRecord(a); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf strings.Builder
+	b.Explain = true
+	b.DryRun = true
+	b.Print = func(args ...interface{}) (int, error) { return buf.WriteString(args[0].(string)) }
+	if _, err := b.Build(context.Background(), nil, "testdata/go/greet/greet"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "input testdata/go/greet/greet.go changed"; !strings.Contains(buf.String(), want) {
+		t.Errorf("missing %q in:\n%s", want, buf.String())
+	}
+}
+
+func TestZigTarget(t *testing.T) {
+	for _, tt := range []struct {
+		goos, goarch string
+		want         string
+	}{
+		{"linux", "amd64", "x86_64-linux-gnu"},
+		{"linux", "arm64", "aarch64-linux-gnu"},
+		{"linux", "arm", "arm-linux-gnueabihf"},
+		{"linux", "riscv64", "riscv64-linux-gnu"},
+		{"darwin", "arm64", "aarch64-macos-none"},
+		{"windows", "amd64", "x86_64-windows-gnu"},
+		{"plan9", "amd64", ""},
+		{"darwin", "386", ""},
+	} {
+		got, err := zigTarget(tt.goos, tt.goarch)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s/%s: got %s, want error", tt.goos, tt.goarch, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s/%s: got %s, %v, want %s", tt.goos, tt.goarch, got, err, tt.want)
+		}
+	}
+}
+
+func TestGoToolchain(t *testing.T) {
+	cacheDir := t.TempDir()
+	b := &Builder{CacheDir: cacheDir, DryRun: true}
+	a, err := b.Build(context.Background(), nil, "testdata/cgo/helloc?goarch=arm64&goos=linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The C compilers target the configuration.
+	env := strings.Join(a.cmds[len(a.cmds)-1].Env, "\n")
+	for _, want := range []string{
+		"GOARCH=arm64",
+		"CGO_ENABLED=1",
+		" cc -target aarch64-linux-gnu\n",
+		" c++ -target aarch64-linux-gnu\n",
+		"ZIG_LOCAL_CACHE_DIR=" + filepath.Join(cacheDir, "zig"),
+	} {
+		if !strings.Contains(env+"\n", want) {
+			t.Errorf("missing %q in env:\n%s", want, env)
+		}
+	}
+}
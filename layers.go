@@ -0,0 +1,188 @@
+package laze
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+)
+
+// gzipMagic is the header of gzip compressed files.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isTarFile reports whether the file is a tar archive by extension.
+func isTarFile(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.zst", ".tar.xz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileTar opens a tar archive of the single file at the root, streamed
+// from the file.
+func fileTar(filename string, modTime time.Time) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer f.Close()
+		tw := tar.NewWriter(pw)
+		err := tw.WriteHeader(&tar.Header{
+			Name:     path.Base(filepath.ToSlash(filename)),
+			Size:     fi.Size(),
+			Typeflag: tar.TypeReg,
+			Mode:     int64(fi.Mode().Perm()),
+			ModTime:  modTime,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// decompressedFile closes the decompressor and the file it reads.
+type decompressedFile struct {
+	io.ReadCloser
+	f *os.File
+}
+
+func (d decompressedFile) Close() error {
+	err := d.ReadCloser.Close()
+	if ferr := d.f.Close(); err == nil {
+		err = ferr
+	}
+	return err
+}
+
+// openDecompressed opens the archive decompressed by extension.
+func openDecompressed(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decompressReader(filename, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return decompressedFile{ReadCloser: r, f: f}, nil
+}
+
+// layerFromFile returns the image layer of a tar archive, or of a tar
+// with the single file for other files, modified at modTime. Archives
+// are added as is, without extracting their entries.
+//
+// Uncompressed archives are compressed once and cached by content in the
+// cache dir. Unchanged layers are reused by digest across builds. Files
+// are hashed and compressed as streams.
+func (b *Builder) layerFromFile(filename string, modTime time.Time, opts ...tarball.LayerOption) (v1.Layer, error) {
+	opener := func() (io.ReadCloser, error) {
+		switch {
+		case strings.HasSuffix(filename, ".tar.zst"), strings.HasSuffix(filename, ".tar.xz"):
+			// Layers are gzip compressed, other formats are recompressed.
+			return openDecompressed(filename)
+		case isTarFile(filename):
+			return os.Open(filename)
+		default:
+			return fileTar(filename, modTime)
+		}
+	}
+
+	r, err := opener()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(gzipMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(magic, gzipMagic) || b.CacheDir == "" {
+		return tarball.LayerFromOpener(opener,
+			append(opts, tarball.WithCompressedCaching)...,
+		)
+	}
+
+	h := sha256.New()
+	if _, err := io.Copy(h, br); err != nil {
+		return nil, err
+	}
+	name := filepath.Join(b.CacheDir, "layers", hex.EncodeToString(h.Sum(nil))+".tar.gz")
+	if _, err := os.Stat(name); err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err := writeCompressed(name, opener); err != nil {
+			return nil, fmt.Errorf("caching layer: %w", err)
+		}
+	} else {
+		b.Log.Debugf("reusing layer %s for %s", name, filename)
+	}
+	return tarball.LayerFromFile(name, opts...)
+}
+
+// writeCompressed writes the gzip compressed contents of the opener
+// atomically.
+func writeCompressed(name string, opener tarball.Opener) error {
+	r, err := opener()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), "layer")
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(f, gzip.BestSpeed)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
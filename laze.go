@@ -2,14 +2,20 @@
 package laze
 
 import (
+	"bytes"
 	"container/heap"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/url"
 	"os"
 	"path"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/emcfarlane/starlarkassert"
@@ -28,7 +34,8 @@ var (
 type Action struct {
 	Deps []*Action // Actions this action depends on.
 
-	Key string // Key is the labels path.
+	Key   string // Key is the labels path.
+	Label string // Label is the full label URL.
 
 	// REMOTE: 	http://network.com/file/path
 	// ABSOLUTE: 	file:///root/file/path
@@ -36,6 +43,15 @@ type Action struct {
 	// RELATIVE: 	file ./file ../file
 	Func func(*starlark.Thread) (starlark.Value, error)
 
+	rule    *rule               // rule of the action, nil for files
+	args    starlark.StringDict // resolved rule arguments
+	config  configuration       // target platform, zero for the host
+	cmds    []*command          // commands recorded on execution
+	log     bytes.Buffer        // captured output of commands and prints
+	rec     *actionRecord       // cache record of the action inputs
+	inputs  []string            // files read on execution, by workspace path
+	stamped bool                // whether the action read the workspace status
+
 	triggers []*Action // reverse of deps
 	pending  int       // number of actions pending
 	priority int       // relative execution priority
@@ -127,13 +143,114 @@ type Builder struct {
 	Dir    string // directory
 	tmpDir string // temporary directory TODO: caching tmp dir?
 
-	actionCache map[string]*Action // a cache of already-constructed actions
-	rulesCache  map[string]*rule   // a cache of created rules
-	moduleCache map[string]bool    // a cache of modules
+	// Print writes action output, nil to discard. cmd/laze prints to
+	// os.Stderr.
+	Print func(args ...interface{}) (int, error)
+	Log   *Logger // leveled logger, nil to discard
+
+	DryRun   bool   // record commands without executing them
+	Explain  bool   // print why actions are or are not up to date
+	Stamp    bool   // stamp outputs with the workspace status
+	CacheDir string // action cache directory, disabled if empty
+
+	Output   OutputMode // captured action output to print
+	LogDir   string     // directory of per-action logs, disabled if empty
+	Terminal io.Writer  // terminal for progress of running actions, disabled if nil
+
+	actionCache map[string]*Action   // a cache of already-constructed actions
+	rulesCache  map[string]*rule     // a cache of created rules
+	moduleCache map[string]bool      // a cache of modules
+	starCache   map[string]time.Time // modtimes of starlark files, zero if missing
+
+	stampMu sync.Mutex
+	stamp   map[string]string // workspace status of the build, nil until used
+
+	stableStatus string // hash of the stable status, empty unless stamping
+
+	workspace *workspace // workspace config of the build
 	//filesCache  map[string]bool    // a cache of files
 
 }
 
+func (b *Builder) print(args ...interface{}) {
+	if b.Print != nil {
+		b.Print(args...)
+	}
+}
+
+// statStar records the modification time of a starlark file so changes
+// can be detected by stale.
+func (b *Builder) statStar(name string) (os.FileInfo, error) {
+	if b.starCache == nil {
+		b.starCache = make(map[string]time.Time)
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		b.starCache[name] = time.Time{}
+		return nil, err
+	}
+	b.starCache[name] = fi.ModTime()
+	return fi, nil
+}
+
+// stale reports whether any starlark file seen by the builder has been
+// created, modified or removed since it was loaded.
+func (b *Builder) stale() bool {
+	for name, modTime := range b.starCache {
+		fi, err := os.Stat(name)
+		if err != nil {
+			if !modTime.IsZero() {
+				return true
+			}
+			continue
+		}
+		if !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPackage loads the BUILD.star module in dir, if it exists.
+func (b *Builder) loadPackage(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsDir() {
+		return fmt.Errorf("invalid path %v", dir)
+	}
+	// Load module.
+	module := path.Join(dir, "BUILD.star")
+	exists := func(name string) bool {
+		if _, err := b.statStar(name); err != nil {
+			if os.IsNotExist(err) {
+				return false
+			}
+		}
+		return true
+	}
+
+	if ok := b.moduleCache[module]; !ok && exists(module) {
+		thread := &starlark.Thread{Load: b.load}
+		d, err := b.load(thread, module)
+		if err != nil {
+			return err
+		}
+
+		// rule will inject the value?
+		for key, val := range d {
+			b.Log.Debugf("module %s: %s = %s", module, key, val)
+		}
+		if b.moduleCache == nil {
+			b.moduleCache = make(map[string]bool)
+		}
+		b.moduleCache[module] = true
+	}
+	return nil
+}
+
 // TODO: how globals work?
 var globals = starlark.StringDict{
 	"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
@@ -152,7 +269,10 @@ func (b *Builder) load(thread *starlark.Thread, module string) (starlark.StringD
 		}, nil
 	}
 
-	fmt.Println("trying to load", module)
+	b.Log.Debugf("loading %s", module)
+	if _, err := b.statStar(module); err != nil {
+		return nil, err
+	}
 	src, err := ioutil.ReadFile(module)
 	if err != nil {
 		return nil, err
@@ -163,9 +283,19 @@ func (b *Builder) load(thread *starlark.Thread, module string) (starlark.StringD
 		defer thread.SetLocal("module", module)
 	}
 	thread.SetLocal("module", module)
-	fmt.Println("setting module", module)
 
-	return starlark.ExecFile(thread, module, src, globals)
+	d, err := starlark.ExecFile(thread, module, src, globals)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rules are named by their exported global.
+	for name, v := range d {
+		if r, ok := v.(*rule); ok && r.kind == "" {
+			r.kind = name
+		}
+	}
+	return d, nil
 }
 
 func (b *Builder) addAction(label string, action *Action) *Action {
@@ -181,10 +311,6 @@ func parseLabel(label string, dir string) (*url.URL, error) {
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("%+v\n", *u)
-	if err != nil {
-		return nil, fmt.Errorf("error: invalid label %s", label)
-	}
 	if u.Scheme == "" {
 		u.Scheme = "file"
 		if len(u.Path) > 0 && u.Path[0] != '/' {
@@ -203,92 +329,168 @@ func parseLabel(label string, dir string) (*url.URL, error) {
 	return u, nil
 }
 
+// configuration is the target platform of an action. It's set by the
+// goos and goarch query params of a label and transitions to the deps of
+// the action, so a target built for a platform builds its deps for the
+// same platform.
+type configuration struct {
+	goos   string
+	goarch string
+}
+
+// isConfigParam reports whether the query param is part of the
+// configuration. Config params are accepted by all rules.
+func isConfigParam(key string) bool { return key == "goos" || key == "goarch" }
+
+// String names the configuration, empty for the host.
+func (c configuration) String() string {
+	var elems []string
+	for _, s := range []string{c.goos, c.goarch} {
+		if s != "" {
+			elems = append(elems, s)
+		}
+	}
+	return strings.Join(elems, "_")
+}
+
+// transition sets the configuration on the dep label, params already set
+// on the label take precedence.
+func (c configuration) transition(u *url.URL) {
+	q := u.Query()
+	changed := false
+	for key, val := range map[string]string{"goos": c.goos, "goarch": c.goarch} {
+		if val != "" && q.Get(key) == "" {
+			q.Set(key, val)
+			changed = true
+		}
+	}
+	if changed {
+		u.RawQuery = q.Encode()
+	}
+}
+
+// outDir is the directory of the action outputs. Configured actions write
+// under laze-out so builds for each platform don't collide.
+func (a *Action) outDir() string {
+	dir := path.Dir(a.Key)
+	if cfg := a.config.String(); cfg != "" {
+		return path.Join("laze-out", cfg, dir)
+	}
+	return dir
+}
+
 func (b *Builder) createAction(ctx context.Context, u *url.URL) (*Action, error) {
 
 	// TODO: validate URL type
-	// TODO: label needs to be cleaned...
+	// Query params are sorted so equal labels share an action.
+	query := u.Query()
+	if len(query) > 0 {
+		u.RawQuery = query.Encode()
+	}
 	label := u.String()
 	key := u.Path
 	name := path.Base(key)
 	dir := path.Dir(key)
-	fmt.Println("u", u.String(), "key", key, "name", name, "dir", dir)
+	b.Log.Debugf("create action %s: key %s name %s dir %s", label, key, name, dir)
 
 	if action, ok := b.actionCache[label]; ok {
 		return action, nil
 	}
 
-	fi, err := os.Stat(dir)
-	if err != nil {
+	if err := b.loadPackage(dir); err != nil {
 		return nil, err
 	}
 
-	if !fi.Mode().IsDir() {
-		return nil, fmt.Errorf("invalid path %v", dir)
-	}
-	// Load module.
-	module := path.Join(dir, "BUILD.star")
-	exists := func(name string) bool {
-		if _, err := os.Stat(name); err != nil {
-			if os.IsNotExist(err) {
-				return false
-			}
-		}
-		return true
-	}
-
-	if ok := b.moduleCache[module]; !ok && exists(module) {
-		thread := &starlark.Thread{Load: b.load}
-		d, err := b.load(thread, module)
-		if err != nil {
-			return nil, err
-		}
-
-		// rule will inject the value?
-		for key, val := range d {
-			fmt.Println(" - ", key, val)
-		}
-		if b.moduleCache == nil {
-			b.moduleCache = make(map[string]bool)
-		}
-		b.moduleCache[module] = true
-	}
-
 	// Load rule, or file.
 	r, ok := b.rulesCache[key]
 	if !ok {
-		fi, err := os.Stat(key)
-		if err != nil {
+		if _, err := os.Stat(key); err != nil {
 			return nil, fmt.Errorf("error: label not found: %s", label)
 		}
 
-		// File param.
+		// Files are the same in every configuration.
+		if query.Get("goos") != "" || query.Get("goarch") != "" {
+			query.Del("goos")
+			query.Del("goarch")
+			u.RawQuery = query.Encode()
+			return b.createAction(ctx, u)
+		}
+
+		// File param, stat on execution as actions may be rerun.
 		return b.addAction(label, &Action{
-			Deps: nil,
-			Key:  key,
+			Deps:  nil,
+			Key:   key,
+			Label: label,
 			Func: func(*starlark.Thread) (starlark.Value, error) {
+				fi, err := os.Stat(key)
+				if err != nil {
+					return nil, err
+				}
 				return newFile(key, fi)
 			},
 		}), nil
 	}
 
+	// Copy args, the rule is shared between labels.
+	args := make(starlark.StringDict, len(r.args))
+	for key, arg := range r.args {
+		args[key] = arg
+	}
+
+	config := configuration{
+		goos:   query.Get("goos"),
+		goarch: query.Get("goarch"),
+	}
+
 	// Parse query params, override args.
-	for key, vals := range u.Query() {
+	for key, vals := range query {
 		attr, ok := r.attrs[key]
 		if !ok {
+			if isConfigParam(key) {
+				continue
+			}
 			return nil, fmt.Errorf("error: unknown query param: %s", key)
 		}
 
 		switch attr.typ {
-		case attrTypeString:
+		case attrTypeString, attrTypeLabel:
 			if len(vals) > 1 {
 				return nil, fmt.Errorf("error: unexpected number of params: %v", vals)
 			}
 			s := vals[0]
 			// TODO: attr validation?
-			r.args[key] = starlark.String(s)
+			args[key] = starlark.String(s)
+
+		case attrTypeBool:
+			if len(vals) > 1 {
+				return nil, fmt.Errorf("error: unexpected number of params: %v", vals)
+			}
+			v, err := strconv.ParseBool(vals[0])
+			if err != nil {
+				return nil, fmt.Errorf("query param %s: invalid bool %q", key, vals[0])
+			}
+			args[key] = starlark.Bool(v)
+
+		case attrTypeInt:
+			if len(vals) > 1 {
+				return nil, fmt.Errorf("error: unexpected number of params: %v", vals)
+			}
+			v, err := strconv.Atoi(vals[0])
+			if err != nil {
+				return nil, fmt.Errorf("query param %s: invalid int %q", key, vals[0])
+			}
+			args[key] = starlark.MakeInt(v)
+
+		case attrTypeStringList, attrTypeLabelList:
+			// Repeated params are the elements of the list.
+			elems := make([]starlark.Value, len(vals))
+			for i, val := range vals {
+				elems[i] = starlark.String(val)
+			}
+			args[key] = starlark.NewList(elems)
 
 		default:
-			panic("TODO: query parsing")
+			return nil, fmt.Errorf("query param %s: unsupported attr type %s", key, attr.typ)
 		}
 	}
 
@@ -298,17 +500,30 @@ func (b *Builder) createAction(ctx context.Context, u *url.URL) (*Action, error)
 	attrs := make(starlark.StringDict)
 
 	// Find arg deps as attributes and resolve args to targets.
+	// Args are sorted for a stable order of deps.
+	keys := make([]string, 0, len(args))
+	for key := range args {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
 	var deps []*Action
-	for key, arg := range r.args {
+	for _, key := range keys {
+		arg := args[key]
 		attr := r.attrs[key]
 
 		switch attr.typ {
 		case attrTypeLabel:
 			label := string(arg.(starlark.String))
+			if label == "" {
+				attrs[key] = starlark.None
+				continue
+			}
 			u, err := parseLabel(label, dir)
 			if err != nil {
 				return nil, err
 			}
+			config.transition(u)
 			action, err := b.createAction(ctx, u)
 			if err != nil {
 				return nil, fmt.Errorf("action creation: %w", err)
@@ -326,6 +541,7 @@ func (b *Builder) createAction(ctx context.Context, u *url.URL) (*Action, error)
 				if err != nil {
 					return nil, err
 				}
+				config.transition(u)
 				action, err := b.createAction(ctx, u)
 				if err != nil {
 					return nil, fmt.Errorf("action creation: %w", err)
@@ -339,7 +555,24 @@ func (b *Builder) createAction(ctx context.Context, u *url.URL) (*Action, error)
 			attrs[key] = starlark.NewList(elems)
 
 		case attrTypeLabelKeyedStringDict:
-			panic("TODO")
+			dict := starlark.NewDict(0)
+			for _, item := range arg.(*starlark.Dict).Items() {
+				label := string(item[0].(starlark.String))
+				u, err := parseLabel(label, dir)
+				if err != nil {
+					return nil, err
+				}
+				config.transition(u)
+				action, err := b.createAction(ctx, u)
+				if err != nil {
+					return nil, fmt.Errorf("action creation: %w", err)
+				}
+				deps = append(deps, action)
+				if err := dict.SetKey(newTarget(label, action), item[1]); err != nil {
+					return nil, err
+				}
+			}
+			attrs[key] = dict
 
 		default:
 			// copy
@@ -347,16 +580,35 @@ func (b *Builder) createAction(ctx context.Context, u *url.URL) (*Action, error)
 		}
 	}
 
-	return b.addAction(label, &Action{
-		Deps: deps,
-		Key:  key,
-		Func: func(thread *starlark.Thread) (starlark.Value, error) {
-			args := starlark.Tuple{
-				newCtxModule(ctx, key, b.Dir, b.tmpDir, attrs),
-			}
-			return starlark.Call(thread, r.impl, args, nil)
-		},
-	}), nil
+	action := &Action{
+		Deps:   deps,
+		Key:    key,
+		Label:  label,
+		rule:   r,
+		args:   args,
+		config: config,
+	}
+	// The context of the build is set on the thread by Do, actions are
+	// reused between builds.
+	action.Func = func(thread *starlark.Thread) (starlark.Value, error) {
+		c, err := newCtxModule(threadContext(thread), b, action, attrs)
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Call(thread, r.impl, starlark.Tuple{c}, nil)
+	}
+	return b.addAction(label, action), nil
+}
+
+// contextKey is the thread local of the context of the build, set by Do.
+const contextKey = "context"
+
+// threadContext returns the context of the build running on the thread.
+func threadContext(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local(contextKey).(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
 }
 
 // TODO: caching with tmp dir.
@@ -405,12 +657,100 @@ func (b *Builder) Build(ctx context.Context, args []string, label string) (*Acti
 		return nil, err
 	}
 
+	ws, err := b.loadWorkspace()
+	if err != nil {
+		return nil, fmt.Errorf("workspace: %w", err)
+	}
+	b.workspace = ws
+
+	// Workspace status may change between builds.
+	if err := b.loadStatus(ctx, ws); err != nil {
+		return nil, err
+	}
+
+	all := actionList(root)
+	if b.CacheDir != "" || b.Explain {
+		if err := b.recordActions(all, false); err != nil {
+			return nil, err
+		}
+	}
+	if b.Explain {
+		for _, a := range all {
+			reason, err := b.explain(a)
+			if err != nil {
+				return nil, err
+			}
+			b.print(fmt.Sprintf("%s: %s\n", a.Label, reason))
+		}
+	}
+
 	b.Do(ctx, root)
-	fmt.Println("completed action", root.Key, root.Value, root.Error)
+	b.Log.Debugf("completed action %s: %v %v", root.Label, root.Value, root.Error)
 
+	if !b.DryRun && b.CacheDir != "" {
+		// Record the inputs the actions read.
+		if err := b.recordActions(all, true); err != nil {
+			return nil, err
+		}
+		for _, a := range all {
+			if a.Failed {
+				continue
+			}
+			if err := b.saveRecord(a); err != nil {
+				return nil, err
+			}
+		}
+	}
 	return root, nil
 }
 
+// WritePlan writes the actions of the dag rooted at root in execution
+// order. Each action lists its rule, attributes, recorded commands and
+// outputs. Used with DryRun to show what a build would do.
+func WritePlan(w io.Writer, root *Action) error {
+	var buf strings.Builder
+	for _, a := range actionList(root) {
+		fmt.Fprintf(&buf, "action %s\n", a.Label)
+		fmt.Fprintf(&buf, "  rule: %s\n", a.kind())
+
+		if len(a.args) > 0 {
+			names := make([]string, 0, len(a.args))
+			for name := range a.args {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+
+			buf.WriteString("  attrs:\n")
+			for _, name := range names {
+				fmt.Fprintf(&buf, "    %s = %s\n", name, a.args[name])
+			}
+		}
+
+		var outputs []string
+		for _, cmd := range a.cmds {
+			fmt.Fprintf(&buf, "  command: %s\n", cmd)
+			if len(cmd.Env) > 0 {
+				fmt.Fprintf(&buf, "    env: %s\n", shellQuote(cmd.Env...))
+			}
+			if cmd.Dir != "" {
+				fmt.Fprintf(&buf, "    cwd: %s\n", cmd.Dir)
+			}
+			outputs = append(outputs, cmd.Outputs...)
+		}
+		if len(outputs) > 0 {
+			buf.WriteString("  outputs:\n")
+			for _, output := range outputs {
+				fmt.Fprintf(&buf, "    %s\n", output)
+			}
+		}
+		if a.Failed {
+			fmt.Fprintf(&buf, "  error: %v\n", a.Error)
+		}
+	}
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
 // actionList returns the list of actions in the dag rooted at root
 // as visited in a depth-first post-order traversal.
 func actionList(root *Action) []*Action {
@@ -444,6 +784,18 @@ func (b *Builder) Do(ctx context.Context, root *Action) {
 		ready  actionQueue
 	)
 
+	// Reset results, actions are reused between builds.
+	for _, a := range all {
+		a.cmds = nil
+		a.inputs = nil
+		a.log.Reset()
+		a.triggers = nil
+		a.Value = nil
+		a.Error = nil
+		a.Failed = false
+		a.stamped = false
+	}
+
 	// Initialize per-action execution state.
 	for _, a := range all {
 		for _, a1 := range a.Deps {
@@ -462,25 +814,44 @@ func (b *Builder) Do(ctx context.Context, root *Action) {
 	jobs := make(chan *Action, par)
 	done := make(chan *Action, par)
 	workerN := par
+
+	s := b.newStatus(len(all))
+	defer s.close()
+
 	for i := 0; i < par; i++ {
 		go func() {
 			thread := &starlark.Thread{}
+			thread.SetLocal(contextKey, ctx)
 
 			for a := range jobs {
+				// Capture starlark prints in the action log.
+				a := a
+				thread.Print = func(_ *starlark.Thread, msg string) {
+					a.log.WriteString(msg)
+					a.log.WriteByte('\n')
+				}
+
 				// Run job.
 				var value starlark.Value = starlark.None
 				var err error
-				fmt.Println("RUNNING ACTION", a.Key, "failed?", a.Failed)
-				if a.Func != nil && !a.Failed {
-					value, err = a.Func(thread)
+				b.Log.Debugf("running action %s: failed %t", a.Label, a.Failed)
+				run := a.Func != nil && !a.Failed
+				if run {
+					s.started(a)
+					// Canceled builds fail the remaining actions.
+					if err = ctx.Err(); err == nil {
+						value, err = a.Func(thread)
+					}
 				}
 				if err != nil {
-					// Log?
 					a.Failed = true
 					a.Error = err
 				}
 				a.Value = value
 				a.TimeDone = time.Now()
+				if run {
+					s.finished(a)
+				}
 
 				done <- a
 			}
@@ -496,10 +867,8 @@ func (b *Builder) Do(ctx context.Context, root *Action) {
 			workerN--
 		}
 
-		fmt.Println("waiting for action")
 		// Wait for completed actions via the done queue.
 		a := <-done
-		fmt.Println("got action")
 		workerN++
 
 		for _, a0 := range a.triggers {
@@ -512,5 +881,5 @@ func (b *Builder) Do(ctx context.Context, root *Action) {
 			}
 		}
 	}
-	fmt.Println("completed do")
+	b.Log.Debugf("completed %d actions", len(all))
 }
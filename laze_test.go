@@ -1,7 +1,13 @@
 package laze
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"go.starlark.net/starlark"
@@ -168,3 +174,208 @@ func TestLabels(t *testing.T) {
 		})
 	}
 }
+
+func TestDryRun(t *testing.T) {
+	b := Builder{DryRun: true}
+
+	ctx := context.Background()
+	a, err := b.Build(ctx, nil, "testdata/packaging/helloc.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("testdata/packaging/helloc.tar.gz"); !os.IsNotExist(err) {
+		t.Fatalf("dry run created output: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePlan(&buf, a); err != nil {
+		t.Fatal(err)
+	}
+	// Configured outputs are written under laze-out.
+	out, err := filepath.Abs("laze-out/linux_amd64/testdata/cgo/helloc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"action file://testdata/cgo/helloc?goarch=amd64&goos=linux\n  rule: go\n",
+		"  command: go list -json -deps .\n",
+		"  command: go build -trimpath -o " + out + " .\n",
+		"    env: GOOS=linux GOARCH=amd64 CGO_ENABLED=1",
+		"    cwd: testdata/cgo\n",
+		"  command: packaging.tar package_dir=/usr/bin strip_prefix=../cgo\n" +
+			"  outputs:\n    testdata/packaging/helloc.tar.gz\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %q in plan:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	for _, tt := range []struct {
+		label   string
+		want    string // in the plan
+		wantErr string
+	}{
+		{label: "testdata/go/hello?cgo=false", want: "CGO_ENABLED=0"},
+		{label: "testdata/go/hello?cgo=True", want: "CGO_ENABLED=1"},
+		{label: "testdata/go/hello?tags=netgo&tags=osusergo", want: "-tags netgo,osusergo"},
+		{label: "testdata/go/greet/greet_sharded_test?shard_count=3", want: "go test -c"},
+		{label: "testdata/go/hello?cgo=maybe", wantErr: `query param cgo: invalid bool "maybe"`},
+		{label: "testdata/go/greet/greet_sharded_test?shard_count=x", wantErr: `query param shard_count: invalid int "x"`},
+		{label: "testdata/go/hello?x_defs=main.name", wantErr: "query param x_defs: unsupported attr type attr.string_dict"},
+	} {
+		b := Builder{DryRun: true}
+		a, err := b.Build(context.Background(), nil, tt.label)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, want %q", tt.label, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.label, err)
+			continue
+		}
+		var buf bytes.Buffer
+		if err := WritePlan(&buf, a); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(buf.String(), tt.want) {
+			t.Errorf("%s: missing %q in plan:\n%s", tt.label, tt.want, buf.String())
+		}
+	}
+}
+
+func TestExplain(t *testing.T) {
+	var buf bytes.Buffer
+	b := Builder{
+		CacheDir: t.TempDir(),
+		Explain:  true,
+		DryRun:   true,
+		Print:    func(args ...interface{}) (int, error) { return fmt.Fprint(&buf, args...) },
+	}
+
+	ctx := context.Background()
+	if _, err := b.Build(ctx, nil, "testdata/go/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "file://testdata/go/hello: not cached: no previous build\n"; !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing %q in:\n%s", want, buf.String())
+	}
+
+	// Save records as if built.
+	a := b.actionCache["file://testdata/go/hello"]
+	for _, a := range actionList(a) {
+		if err := b.saveRecord(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buf.Reset()
+	if _, err := b.Build(ctx, nil, "testdata/go/hello"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "file://testdata/go/hello: up to date\n"; !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing %q in:\n%s", want, buf.String())
+	}
+
+	buf.Reset()
+	if _, err := b.Build(ctx, nil, "testdata/go/hello?goos=linux"); err != nil {
+		t.Fatal(err)
+	}
+	if want := "file://testdata/go/hello?goos=linux: not cached: no previous build\n"; !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing %q in:\n%s", want, buf.String())
+	}
+}
+
+func TestOutput(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "BUILD.star"), []byte(`
+load("rule.star", "attr", "rule")
+
+def _shell_impl(ctx):
+    print("running", ctx.attrs.name)
+    ctx.actions.run(name = "sh", args = ["-c", ctx.attrs.cmd])
+
+shell = rule(
+    impl = _shell_impl,
+    attrs = {
+        "cmd": attr.string(),
+    },
+)
+
+shell(
+    name = "warn",
+    cmd = "echo warning: careful",
+)
+
+shell(
+    name = "fail",
+    cmd = "echo oops; exit 3",
+)
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		label  string
+		output OutputMode
+		want   string
+	}{{
+		name:   "errors",
+		label:  "fail",
+		output: OutputErrors,
+		want: "FAIL: file://" + dir + "/fail (shell)\n" +
+			"$ cd " + dir + " && sh -c 'echo oops; exit 3'\n" +
+			"running fail\n" +
+			"oops\n" +
+			"error: exit status 3\n",
+	}, {
+		name:   "errorsQuiet",
+		label:  "warn",
+		output: OutputErrors,
+		want:   "",
+	}, {
+		name:   "all",
+		label:  "warn",
+		output: OutputAll,
+		want: "file://" + dir + "/warn: running warn\n" +
+			"file://" + dir + "/warn: warning: careful\n",
+	}, {
+		name:   "none",
+		label:  "fail",
+		output: OutputNone,
+		want:   "",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logDir := t.TempDir()
+			b := Builder{
+				Output: tt.output,
+				LogDir: logDir,
+				Print:  func(args ...interface{}) (int, error) { return fmt.Fprint(&buf, args...) },
+			}
+			if _, err := b.Build(context.Background(), nil, path.Join(dir, tt.label)); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+
+			log, err := os.ReadFile(filepath.Join(logDir, logName("file://"+dir+"/"+tt.label)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "output:\nrunning " + tt.label + "\n"; !strings.Contains(string(log), want) {
+				t.Fatalf("log missing %q:\n%s", want, log)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package laze
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// LogLevel is the verbosity of a Logger.
+type LogLevel int
+
+const (
+	LevelError LogLevel = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+)
+
+var levelPrefix = [...]string{
+	LevelError: "error: ",
+	LevelWarn:  "warning: ",
+	LevelInfo:  "",
+	LevelDebug: "debug: ",
+}
+
+// Logger is a leveled logger. A nil *Logger discards all messages.
+type Logger struct {
+	Level LogLevel // maximum level logged
+	l     *log.Logger
+}
+
+// NewLogger returns a logger writing messages up to level to w.
+func NewLogger(w io.Writer, level LogLevel) *Logger {
+	return &Logger{Level: level, l: log.New(w, "", 0)}
+}
+
+func (l *Logger) logf(level LogLevel, format string, args ...interface{}) {
+	if l == nil || level > l.Level {
+		return
+	}
+	l.l.Print(levelPrefix[level] + fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) { l.logf(LevelError, format, args...) }
+func (l *Logger) Warnf(format string, args ...interface{})  { l.logf(LevelWarn, format, args...) }
+func (l *Logger) Infof(format string, args ...interface{})  { l.logf(LevelInfo, format, args...) }
+func (l *Logger) Debugf(format string, args ...interface{}) { l.logf(LevelDebug, format, args...) }
+
+// newLogModule exposes the logger to rules as ctx.actions.log.
+func newLogModule(l *Logger, key string) *starlarkstruct.Module {
+	logFn := func(name string, level LogLevel) *starlark.Builtin {
+		return starlark.NewBuiltin("log."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if len(kwargs) > 0 {
+				return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+			}
+			var msg string
+			for i, arg := range args {
+				if i > 0 {
+					msg += " "
+				}
+				if s, ok := starlark.AsString(arg); ok {
+					msg += s
+				} else {
+					msg += arg.String()
+				}
+			}
+			l.logf(level, "%s: %s", key, msg)
+			return starlark.None, nil
+		})
+	}
+	return &starlarkstruct.Module{
+		Name: "log",
+		Members: starlark.StringDict{
+			"error": logFn("error", LevelError),
+			"warn":  logFn("warn", LevelWarn),
+			"info":  logFn("info", LevelInfo),
+			"debug": logFn("debug", LevelDebug),
+		},
+	}
+}
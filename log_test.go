@@ -0,0 +1,23 @@
+package laze
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, LevelWarn)
+	l.Errorf("a %d", 1)
+	l.Warnf("b")
+	l.Infof("c")
+	l.Debugf("d")
+
+	if got, want := buf.String(), "error: a 1\nwarning: b\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Nil loggers discard.
+	var nl *Logger
+	nl.Errorf("discarded")
+}
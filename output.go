@@ -0,0 +1,243 @@
+package laze
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OutputMode controls which captured action output is printed.
+type OutputMode int
+
+const (
+	OutputErrors OutputMode = iota // output of failed actions
+	OutputAll                      // output of all actions
+	OutputNone                     // no output
+)
+
+// ParseOutputMode parses "errors", "all" or "none".
+func ParseOutputMode(s string) (OutputMode, error) {
+	switch s {
+	case "errors":
+		return OutputErrors, nil
+	case "all":
+		return OutputAll, nil
+	case "none":
+		return OutputNone, nil
+	default:
+		return 0, fmt.Errorf("unknown output mode: %q", s)
+	}
+}
+
+// runError is returned by actions.run when the command fails.
+type runError struct {
+	cmd *command
+	err error
+}
+
+func (e *runError) Error() string { return fmt.Sprintf("%s: %v", e.cmd, e.err) }
+func (e *runError) Unwrap() error { return e.err }
+
+// commandLine returns a shell command line reproducing the command.
+func (c *command) commandLine() string {
+	var b strings.Builder
+	if c.Dir != "" {
+		b.WriteString("cd ")
+		b.WriteString(shellQuote(c.Dir))
+		b.WriteString(" && ")
+	}
+	if len(c.Env) > 0 {
+		b.WriteString(shellQuote(c.Env...))
+		b.WriteString(" ")
+	}
+	b.WriteString(c.String())
+	return b.String()
+}
+
+// logName is the file name of the action log in the log dir.
+func logName(label string) string {
+	name := strings.TrimPrefix(label, "file://")
+	name = strings.TrimLeft(name, "/")
+	name = strings.NewReplacer("?", "@", "&", ",", ":", "_").Replace(name)
+	return filepath.FromSlash(name) + ".log"
+}
+
+// status tracks running actions, printing action output and redrawing
+// progress lines on the terminal.
+type status struct {
+	b     *Builder
+	total int
+
+	mu      sync.Mutex
+	done    int
+	running map[*Action]time.Time
+	lines   int // progress lines currently drawn
+	stop    chan struct{}
+}
+
+func (b *Builder) newStatus(total int) *status {
+	s := &status{
+		b:       b,
+		total:   total,
+		running: make(map[*Action]time.Time),
+		stop:    make(chan struct{}),
+	}
+	if b.Terminal != nil {
+		go func() {
+			ticker := time.NewTicker(500 * time.Millisecond)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					s.mu.Lock()
+					s.redraw()
+					s.mu.Unlock()
+				case <-s.stop:
+					return
+				}
+			}
+		}()
+	}
+	return s
+}
+
+// close clears the progress lines.
+func (s *status) close() {
+	close(s.stop)
+	s.mu.Lock()
+	s.clear()
+	s.mu.Unlock()
+}
+
+func (s *status) clear() {
+	if s.b.Terminal == nil || s.lines == 0 {
+		return
+	}
+	// Move up and clear to the end of screen.
+	fmt.Fprintf(s.b.Terminal, "\x1b[%dA\x1b[J", s.lines)
+	s.lines = 0
+}
+
+func (s *status) redraw() {
+	if s.b.Terminal == nil {
+		return
+	}
+	s.clear()
+
+	actions := make([]*Action, 0, len(s.running))
+	for a := range s.running {
+		actions = append(actions, a)
+	}
+	sort.Slice(actions, func(i, j int) bool {
+		return s.running[actions[i]].Before(s.running[actions[j]])
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "[%d/%d] %d running\n", s.done, s.total, len(actions))
+	now := time.Now()
+	for _, a := range actions {
+		elapsed := now.Sub(s.running[a]).Truncate(100 * time.Millisecond)
+		fmt.Fprintf(&buf, "    %s (%s)\n", a.Label, elapsed)
+	}
+	s.lines = 1 + len(actions)
+	s.b.Terminal.Write(buf.Bytes())
+}
+
+// print writes output above the progress lines.
+func (s *status) print(output string) {
+	s.clear()
+	s.b.print(output)
+	s.redraw()
+}
+
+func (s *status) started(a *Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[a] = time.Now()
+	s.redraw()
+}
+
+func (s *status) finished(a *Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.running, a)
+	s.done++
+
+	if err := s.b.writeLog(a); err != nil {
+		s.clear()
+		s.b.Log.Warnf("%s: writing log: %v", a.Label, err)
+	}
+
+	switch {
+	case s.b.Output == OutputNone:
+	case a.Error != nil:
+		s.print(formatFailure(a))
+	case s.b.Output == OutputAll && a.log.Len() > 0:
+		s.print(prefixLines(a.Label+": ", a.log.String()))
+	}
+	s.redraw()
+}
+
+// formatFailure describes the failed action, the command that failed and
+// its captured output.
+func formatFailure(a *Action) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "FAIL: %s (%s)\n", a.Label, a.kind())
+
+	var rerr *runError
+	if errors.As(a.Error, &rerr) {
+		fmt.Fprintf(&b, "$ %s\n", rerr.cmd.commandLine())
+	}
+	b.WriteString(a.log.String())
+	if a.log.Len() > 0 && !strings.HasSuffix(a.log.String(), "\n") {
+		b.WriteString("\n")
+	}
+	if rerr != nil {
+		fmt.Fprintf(&b, "error: %v\n", rerr.err)
+	} else {
+		fmt.Fprintf(&b, "error: %v\n", a.Error)
+	}
+	return b.String()
+}
+
+func prefixLines(prefix, s string) string {
+	var b strings.Builder
+	scanner := bufio.NewScanner(strings.NewReader(s))
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		b.WriteString(prefix)
+		b.WriteString(scanner.Text())
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// writeLog saves the commands and captured output of the action.
+func (b *Builder) writeLog(a *Action) error {
+	if b.LogDir == "" || len(a.cmds) == 0 {
+		return nil
+	}
+	name := filepath.Join(b.LogDir, logName(a.Label))
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "action: %s\n", a.Label)
+	for _, cmd := range a.cmds {
+		fmt.Fprintf(&buf, "command: %s\n", cmd.commandLine())
+	}
+	if a.Error != nil {
+		fmt.Fprintf(&buf, "error: %v\n", a.Error)
+	}
+	buf.WriteString("output:\n")
+	buf.Write(a.log.Bytes())
+	return os.WriteFile(name, buf.Bytes(), 0666)
+}
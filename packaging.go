@@ -2,14 +2,22 @@ package laze
 
 import (
 	"archive/tar"
+	"archive/zip"
+	"bytes"
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
 )
@@ -24,114 +32,765 @@ func newPackagingModule(a *actions) *starlarkstruct.Module {
 		Name: "container",
 		Members: starlark.StringDict{
 			"tar": starlark.NewBuiltin("packaging.tar", p.tar),
+			"deb": starlark.NewBuiltin("packaging.deb", p.deb),
 		},
 	}
 }
 
-// tar creates a tarball.
-func (p *packaging) tar(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var (
-		name        string
-		srcs        *starlark.List
-		packageDir  string
-		stripPrefix string
-	)
-	if err := starlark.UnpackArgs(
-		"tar", args, kwargs,
-		"name", &name, "srcs", &srcs, "package_dir?", &packageDir, "strip_prefix?", &stripPrefix,
-	); err != nil {
+// tarEntry is a file, directory or symlink of a tar archive.
+type tarEntry struct {
+	hdr      *tar.Header
+	src      string // file of the contents, empty for directories and links
+	offset   int64  // offset of the contents in src
+	data     []byte // contents of generated files
+	archived bool   // entry of an archive, it keeps its owner
+}
+
+// open opens the contents of a regular file entry.
+func (e *tarEntry) open() (io.ReadCloser, error) {
+	if e.src == "" {
+		return io.NopCloser(bytes.NewReader(e.data)), nil
+	}
+	f, err := os.Open(e.src)
+	if err != nil {
 		return nil, err
 	}
+	if !e.archived {
+		return f, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(f, e.offset, e.hdr.Size), f}, nil
+}
+
+// tarBuilder collects the entries of a tar archive, written sorted by
+// name with the same time and owner for reproducible archives.
+type tarBuilder struct {
+	modTime      time.Time
+	uid, gid     int
+	uname, gname string
+	modes        map[string]int64  // mode overrides by name
+	prefix       string            // prefix of entry names, like "./"
+	conflict     string            // policy of duplicate entries
+	remaps       map[string]string // file path prefixes to rename
+	remapped     map[string]bool   // remaps prefixes used
 
-	creationTime := time.Time{} // zero
-	filename := p.key
+	entries map[string]*tarEntry
+}
+
+// tarName is the entry name of p, modes match names without the leading
+// slash.
+func tarName(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
 
-	createTar := func(filename string) error {
-		f, err := os.Create(filename)
+func (t *tarBuilder) add(name string, e *tarEntry) error {
+	if t.entries == nil {
+		t.entries = make(map[string]*tarEntry)
+	}
+	key := tarName(name)
+	if key == "" {
+		return nil // root
+	}
+	if old, ok := t.entries[key]; ok {
+		// Directories may be added by several sources.
+		if old.hdr.Typeflag == tar.TypeDir && e.hdr.Typeflag == tar.TypeDir {
+			return nil
+		}
+		switch t.conflict {
+		case conflictFirst:
+			return nil
+		case conflictLast:
+			// replaced below
+		default:
+			return fmt.Errorf("duplicate tar entry %q", name)
+		}
+	}
+	e.hdr.Name = name
+	t.entries[key] = e
+	return nil
+}
+
+// Conflict policies of duplicate entries, directories are always merged.
+const (
+	conflictError = "error" // fail the build
+	conflictFirst = "first" // keep the entry added first
+	conflictLast  = "last"  // replace with the entry added last
+)
+
+func checkConflict(s string) error {
+	switch s {
+	case conflictError, conflictFirst, conflictLast:
+		return nil
+	default:
+		return fmt.Errorf("invalid conflict %q, want %q, %q or %q",
+			s, conflictError, conflictFirst, conflictLast)
+	}
+}
+
+// addDir adds an empty directory.
+func (t *tarBuilder) addDir(name string) error {
+	return t.add(name, &tarEntry{hdr: &tar.Header{
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+	}})
+}
+
+// addSymlink adds a symbolic link to target.
+func (t *tarBuilder) addSymlink(name, target string) error {
+	return t.add(name, &tarEntry{hdr: &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Linkname: target,
+		Mode:     0777,
+	}})
+}
+
+// addData adds a regular file of data.
+func (t *tarBuilder) addData(name string, data []byte, mode int64) error {
+	return t.add(name, &tarEntry{
+		hdr: &tar.Header{
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(data)),
+			Mode:     mode,
+		},
+		data: data,
+	})
+}
+
+// remap renames the path by the longest matching remaps prefix.
+func (t *tarBuilder) remap(name string) string {
+	key := tarName(name)
+	match := ""
+	for prefix := range t.remaps {
+		if (key == prefix || strings.HasPrefix(key, prefix+"/")) && len(prefix) > len(match) {
+			match = prefix
+		}
+	}
+	if match == "" {
+		return name
+	}
+	if t.remapped == nil {
+		t.remapped = make(map[string]bool)
+	}
+	t.remapped[match] = true
+
+	dest := path.Join(t.remaps[match], strings.TrimPrefix(key, match))
+	if strings.HasPrefix(name, "/") {
+		dest = "/" + dest
+	}
+	return dest
+}
+
+// addFile adds the file as name. Directories are added recursively and
+// symlinks are kept.
+func (t *tarBuilder) addFile(name, filename string) error {
+	fi, err := os.Lstat(filename)
+	if err != nil {
+		return err
+	}
+	// Directory entries are renamed by their own path.
+	dest := t.remap(name)
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filename)
 		if err != nil {
 			return err
 		}
-		defer f.Close()
+		return t.addSymlink(dest, target)
 
-		// compress writer
-		var cw io.WriteCloser
-		switch {
-		case strings.HasSuffix(filename, ".tar.gz"):
-			cw = gzip.NewWriter(f)
-			defer cw.Close()
-		default:
-			cw = f
+	case fi.IsDir():
+		if err := t.add(dest, &tarEntry{hdr: &tar.Header{
+			Typeflag: tar.TypeDir,
+			Mode:     int64(fi.Mode().Perm()),
+		}}); err != nil {
+			return err
+		}
+		des, err := os.ReadDir(filename)
+		if err != nil {
+			return err
+		}
+		for _, de := range des {
+			if err := t.addFile(
+				path.Join(name, de.Name()),
+				filepath.Join(filename, de.Name()),
+			); err != nil {
+				return err
+			}
 		}
+		return nil
 
-		tw := tar.NewWriter(cw)
-		defer tw.Close()
+	case fi.Mode().IsRegular():
+		return t.add(dest, &tarEntry{
+			hdr: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Size:     fi.Size(),
+				Mode:     int64(fi.Mode().Perm()),
+			},
+			src: filename,
+		})
 
-		addFile := func(filename, key string) error {
-			file, err := os.Open(filename)
-			if err != nil {
-				return err
+	default:
+		return fmt.Errorf("%s: unsupported file mode %s", filename, fi.Mode())
+	}
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompressReader decompresses r by the extension of filename, as
+// written by compressWriter.
+func decompressReader(filename string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(filename, ".tar.zst"):
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case strings.HasSuffix(filename, ".tar.xz"):
+		zr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(zr), nil
+	default:
+		return io.NopCloser(r), nil
+	}
+}
+
+// addArchive adds the entries of a tar archive, keeping their headers
+// but the time. Contents of uncompressed archives are read from the
+// archive when written, compressed archives are decompressed to memory.
+func (t *tarBuilder) addArchive(filename string) error {
+	if !isTarFile(filename) {
+		return fmt.Errorf("%s: not a tar archive", filename)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := decompressReader(filename, f)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	defer zr.Close()
+	compressed := !strings.HasSuffix(filename, ".tar")
+
+	cr := &countingReader{r: zr}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			continue
+		case tar.TypeGNUSparse:
+			return fmt.Errorf("%s: %s: sparse files are unsupported", filename, hdr.Name)
+		}
+		for _, key := range []string{"atime", "ctime", "mtime"} {
+			delete(hdr.PAXRecords, key)
+		}
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+
+		e := &tarEntry{hdr: hdr, archived: true}
+		if hdr.Typeflag == tar.TypeReg {
+			if compressed {
+				if e.data, err = io.ReadAll(tr); err != nil {
+					return fmt.Errorf("%s: %w", filename, err)
+				}
+			} else {
+				e.src, e.offset = filename, cr.n
+				if _, err := io.Copy(io.Discard, tr); err != nil {
+					return fmt.Errorf("%s: %w", filename, err)
+				}
+				// Sparse contents aren't stored in order.
+				if cr.n-e.offset != hdr.Size {
+					return fmt.Errorf("%s: %s: sparse files are unsupported", filename, hdr.Name)
+				}
 			}
-			defer file.Close()
+		}
+		if err := t.add(hdr.Name, e); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+}
 
-			stat, err := file.Stat()
-			if err != nil {
+// addParents adds the missing parent directories of every entry.
+func (t *tarBuilder) addParents() error {
+	for key := range t.entries {
+		for dir := path.Dir(key); dir != "."; dir = path.Dir(dir) {
+			if _, ok := t.entries[dir]; ok {
+				break
+			}
+			if err := t.addDir(dir); err != nil {
 				return err
 			}
+		}
+	}
+	return nil
+}
 
-			header := &tar.Header{
-				Name:     key,
-				Size:     stat.Size(),
-				Typeflag: tar.TypeReg,
-				Mode:     int64(stat.Mode()),
-				ModTime:  creationTime,
-			}
-			// write the header to the tarball archive
-			if err := tw.WriteHeader(header); err != nil {
+// keys returns the sorted entry keys, checking every mode override has an
+// entry and every remap a file.
+func (t *tarBuilder) keys() ([]string, error) {
+	for name := range t.modes {
+		if _, ok := t.entries[name]; !ok {
+			return nil, fmt.Errorf("modes: no tar entry %q", name)
+		}
+	}
+	for prefix := range t.remaps {
+		if !t.remapped[prefix] {
+			return nil, fmt.Errorf("remap_paths: no file under %q", prefix)
+		}
+	}
+
+	keys := make([]string, 0, len(t.entries))
+	for key := range t.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// header returns the header of the entry as written.
+func (t *tarBuilder) header(key string) tar.Header {
+	hdr := *t.entries[key].hdr
+	if t.prefix != "" {
+		hdr.Name = t.prefix + key
+	}
+	if hdr.Typeflag == tar.TypeDir && !strings.HasSuffix(hdr.Name, "/") {
+		hdr.Name += "/"
+	}
+	if mode, ok := t.modes[key]; ok {
+		hdr.Mode = mode
+	}
+	hdr.ModTime = t.modTime
+	if !t.entries[key].archived {
+		hdr.Uid, hdr.Gid = t.uid, t.gid
+		hdr.Uname, hdr.Gname = t.uname, t.gname
+	}
+	return hdr
+}
+
+// write writes the archive to w.
+func (t *tarBuilder) write(w io.Writer) error {
+	keys, err := t.keys()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, key := range keys {
+		e := t.entries[key]
+		hdr := t.header(key)
+		if err := tw.WriteHeader(&hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := copyEntry(tw, e); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// zipEpoch is the earliest time of a zip entry, DOS times start at 1980.
+var zipEpoch = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// writeZip writes the entries as a zip archive to w. Zip has no owners,
+// symlinks are stored with the link target as contents.
+func (t *tarBuilder) writeZip(w io.Writer) error {
+	keys, err := t.keys()
+	if err != nil {
+		return err
+	}
+	modTime := t.modTime.UTC()
+	if modTime.Before(zipEpoch) {
+		modTime = zipEpoch
+	}
+
+	zw := zip.NewWriter(w)
+	for _, key := range keys {
+		e := t.entries[key]
+		hdr := t.header(key)
+		zh := &zip.FileHeader{
+			Name:     strings.TrimPrefix(hdr.Name, "/"),
+			Method:   zip.Store,
+			Modified: modTime,
+		}
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			mode |= fs.ModeDir
+		case tar.TypeSymlink:
+			mode |= fs.ModeSymlink
+		case tar.TypeReg:
+			zh.Method = zip.Deflate
+		default:
+			return fmt.Errorf("zip: unsupported entry %q type %c", hdr.Name, hdr.Typeflag)
+		}
+		zh.SetMode(mode)
+
+		fw, err := zw.CreateHeader(zh)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeSymlink:
+			if _, err := io.WriteString(fw, hdr.Linkname); err != nil {
 				return err
 			}
-			// copy the file data to the tarball
-			if _, err := io.Copy(tw, file); err != nil {
+		case tar.TypeReg:
+			if err := copyEntry(fw, e); err != nil {
 				return err
 			}
-			return nil
 		}
+	}
+	return zw.Close()
+}
 
-		iter := srcs.Iterate()
-		defer iter.Done()
+func copyEntry(w io.Writer, e *tarEntry) error {
+	r, err := e.open()
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	r.Close()
+	return err
+}
+
+// parseOwner parses a "uid.gid" or "user.group" pair.
+func parseOwner(s string) (string, string, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("invalid owner %q, want a.b", s)
+	}
+	return parts[0], parts[1], nil
+}
+
+// fileTarget returns the path of a file provider target.
+func fileTarget(x starlark.Value) (string, error) {
+	src, ok := x.(*target)
+	if !ok {
+		return "", fmt.Errorf("invalid src type: %s", x.Type())
+	}
+	fileProvider, err := src.action.loadStructValue(fileConstructor)
+	if err != nil {
+		return "", err
+	}
+	return fileProvider.AttrString("path")
+}
+
+// tarAttrs are the arguments of the files of an archive, shared by the
+// archive builtins.
+type tarAttrs struct {
+	srcs        *starlark.List
+	packageDir  string
+	stripPrefix string
+	files       *starlark.Dict
+	modes       *starlark.Dict
+	owner       string
+	ownerName   string
+	symlinks    *starlark.Dict
+	emptyDirs   *starlark.List
+	deps        *starlark.List
+	conflict    string
+	remapPaths  *starlark.Dict
+}
+
+// pairs returns the starlark.UnpackArgs pairs of the arguments.
+func (a *tarAttrs) pairs() []interface{} {
+	a.owner = "0.0"
+	a.conflict = conflictError
+	return []interface{}{
+		"srcs?", &a.srcs,
+		"package_dir?", &a.packageDir,
+		"strip_prefix?", &a.stripPrefix,
+		"files?", &a.files,
+		"modes?", &a.modes,
+		"owner?", &a.owner,
+		"owner_name?", &a.ownerName,
+		"symlinks?", &a.symlinks,
+		"empty_dirs?", &a.emptyDirs,
+		"deps?", &a.deps,
+		"conflict?", &a.conflict,
+		"remap_paths?", &a.remapPaths,
+	}
+}
+
+// newBuilder returns an empty builder of the headers of the arguments.
+func (a *tarAttrs) newBuilder() (*tarBuilder, error) {
+	modTime, err := creationTime("")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConflict(a.conflict); err != nil {
+		return nil, err
+	}
+	t := &tarBuilder{modTime: modTime, conflict: a.conflict}
+
+	uid, gid, err := parseOwner(a.owner)
+	if err != nil {
+		return nil, err
+	}
+	if t.uid, err = strconv.Atoi(uid); err != nil {
+		return nil, fmt.Errorf("owner uid: %w", err)
+	}
+	if t.gid, err = strconv.Atoi(gid); err != nil {
+		return nil, fmt.Errorf("owner gid: %w", err)
+	}
+	if a.ownerName != "" {
+		if t.uname, t.gname, err = parseOwner(a.ownerName); err != nil {
+			return nil, err
+		}
+	}
+
+	modeStrs, err := dictToStrings(a.modes)
+	if err != nil {
+		return nil, fmt.Errorf("modes: %w", err)
+	}
+	t.modes = make(map[string]int64, len(modeStrs))
+	for key, s := range modeStrs {
+		mode, err := strconv.ParseInt(s, 8, 64)
+		if err != nil {
+			return nil, fmt.Errorf("modes: %s: %w", key, err)
+		}
+		t.modes[tarName(path.Join(a.packageDir, key))] = mode
+	}
+
+	remaps, err := dictToStrings(a.remapPaths)
+	if err != nil {
+		return nil, fmt.Errorf("remap_paths: %w", err)
+	}
+	t.remaps = make(map[string]string, len(remaps))
+	for from, to := range remaps {
+		key := tarName(from)
+		if key == "" {
+			return nil, fmt.Errorf("remap_paths: can't remap the root")
+		}
+		t.remaps[key] = tarName(to)
+	}
+	return t, nil
+}
+
+// srcPath returns the path of the src in the archive, before the
+// package_dir. It's the workspace path of the file relative to the strip
+// prefix: the package dir pkg by default, a path relative to pkg, or to the
+// workspace root if it starts with "/". The prefix "." flattens srcs to
+// their base name.
+func (a *tarAttrs) srcPath(pkg, src string) (string, error) {
+	if a.stripPrefix == "." {
+		return path.Base(src), nil
+	}
+	prefix := pkg
+	switch {
+	case strings.HasPrefix(a.stripPrefix, "/"):
+		prefix = path.Clean(strings.TrimPrefix(a.stripPrefix, "/"))
+	case a.stripPrefix != "":
+		prefix = path.Join(pkg, a.stripPrefix)
+	}
+
+	switch {
+	case prefix == "." || prefix == "":
+		return src, nil
+	case src == prefix:
+		return "", nil // directory contents
+	case strings.HasPrefix(src, prefix+"/"):
+		return strings.TrimPrefix(src, prefix+"/"), nil
+	}
+	if a.stripPrefix == "" {
+		return "", fmt.Errorf("%s isn't in package %s, set strip_prefix", src, pkg)
+	}
+	return "", fmt.Errorf("strip_prefix %q: %s isn't under %s", a.stripPrefix, src, prefix)
+}
+
+// addEntries adds the entries of the deps archives then the files,
+// directories and symlinks of the arguments, in order for conflicts. Srcs
+// are relative to the package dir pkg.
+func (a *tarAttrs) addEntries(t *tarBuilder, pkg string) error {
+	links, err := dictToStrings(a.symlinks)
+	if err != nil {
+		return fmt.Errorf("symlinks: %w", err)
+	}
+	dirs, err := listToStrings(a.emptyDirs)
+	if err != nil {
+		return fmt.Errorf("empty_dirs: %w", err)
+	}
 
+	if a.deps != nil {
+		for i := 0; i < a.deps.Len(); i++ {
+			src, err := fileTarget(a.deps.Index(i))
+			if err != nil {
+				return err
+			}
+			if err := t.addArchive(src); err != nil {
+				return err
+			}
+		}
+	}
+	if a.srcs != nil {
+		iter := a.srcs.Iterate()
+		defer iter.Done()
 		var x starlark.Value
 		for iter.Next(&x) {
-			src, ok := x.(*target)
-			if !ok {
-				return fmt.Errorf("invalid src type")
+			src, err := fileTarget(x)
+			if err != nil {
+				return err
 			}
-
-			fileProvider, err := src.action.loadStructValue(fileConstructor)
+			// Outputs of configured labels are under laze-out, use the
+			// label's path with the name of the file.
+			key := x.(*target).action.Key
+			key = path.Join(path.Dir(key), filepath.Base(src))
+			name, err := a.srcPath(pkg, key)
 			if err != nil {
+				return fmt.Errorf("%s: %w", x.(*target).label, err)
+			}
+			if err := t.addFile(path.Join(a.packageDir, name), src); err != nil {
 				return err
 			}
-			filename, err := fileProvider.AttrString("path")
+		}
+	}
+	if a.files != nil {
+		for _, item := range a.files.Items() {
+			src, err := fileTarget(item[0])
 			if err != nil {
 				return err
 			}
-
-			// Form the key path of the file in the tar fs.
-			key := path.Join(packageDir, strings.TrimPrefix(src.action.Key, stripPrefix))
-
-			// TODO: strip_prefix
-			if err := addFile(filename, key); err != nil {
+			dest, ok := starlark.AsString(item[1])
+			if !ok {
+				return fmt.Errorf("files: got %s, want string", item[1].Type())
+			}
+			if err := t.addFile(path.Join(a.packageDir, dest), src); err != nil {
 				return err
 			}
 		}
-		return nil
 	}
-	if err := createTar(filename); err != nil {
+	for _, dir := range dirs {
+		if err := t.addDir(path.Join(a.packageDir, dir)); err != nil {
+			return err
+		}
+	}
+	for link, target := range links {
+		if err := t.addSymlink(path.Join(a.packageDir, link), target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tar creates a tarball, or a zip archive for names ending in ".zip".
+func (p *packaging) tar(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name  string
+		attrs tarAttrs
+	)
+	if err := starlark.UnpackArgs(
+		"tar", args, kwargs,
+		append([]interface{}{"name", &name}, attrs.pairs()...)...,
+	); err != nil {
+		return nil, err
+	}
+	t, err := attrs.newBuilder()
+	if err != nil {
 		return nil, err
 	}
 
+	filename := p.out
+	if p.record(&command{
+		Name:    "packaging.tar",
+		Args:    []string{"package_dir=" + attrs.packageDir, "strip_prefix=" + attrs.stripPrefix},
+		Outputs: []string{filename},
+	}) {
+		return newPlannedFile(filename)
+	}
+
+	if err := attrs.addEntries(t, path.Dir(p.key)); err != nil {
+		return nil, err
+	}
+	if err := writeTar(filename, t); err != nil {
+		return nil, err
+	}
 	fi, err := os.Stat(filename)
 	if err != nil {
 		return nil, err
 	}
 	return newFile(filename, fi)
 }
+
+// compressWriter compresses to w by the extension of filename:
+// ".tar.gz" and ".tgz" are gzip, ".tar.zst" is zstd and ".tar.xz" is xz.
+// Other names aren't compressed.
+func compressWriter(filename string, w io.Writer) (io.WriteCloser, error) {
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		return gzip.NewWriter(w), nil
+	case strings.HasSuffix(filename, ".tar.zst"):
+		// A single encoder goroutine keeps the output deterministic.
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case strings.HasSuffix(filename, ".tar.xz"):
+		return xz.NewWriter(w)
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// writeTar writes the archive to filename, compressed by extension.
+// Names ending in ".zip" are written as zip archives.
+func writeTar(filename string, t *tarBuilder) error {
+	if err := os.MkdirAll(path.Dir(filename), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(filename, ".zip") {
+		if err := t.writeZip(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	w, err := compressWriter(filename, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := t.write(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
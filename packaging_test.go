@@ -0,0 +1,477 @@
+package laze
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// readTar lists the headers of the archive as "name type mode uid:gid
+// uname:gname linkname", decompressed by extension.
+func readTar(t *testing.T, filename string) []string {
+	t.Helper()
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	switch {
+	case strings.HasSuffix(filename, ".tar.gz"), strings.HasSuffix(filename, ".tgz"):
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case strings.HasSuffix(filename, ".tar.zst"):
+		zr, err := zstd.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	case strings.HasSuffix(filename, ".tar.xz"):
+		zr, err := xz.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	return readTarReader(t, r)
+}
+
+func readTarReader(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	var got []string
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%s %c %04o %d:%d %s:%s %s",
+			hdr.Name, hdr.Typeflag, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Uname, hdr.Gname, hdr.Linkname,
+		))
+	}
+	return got
+}
+
+func TestTar(t *testing.T) {
+	b := Builder{}
+	a, err := b.Build(context.Background(), nil, "testdata/packaging/data.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat("testdata/packaging/data/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileMode := fmt.Sprintf("%04o", fi.Mode().Perm())
+	di, err := os.Stat("testdata/packaging/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirMode := fmt.Sprintf("%04o", di.Mode().Perm())
+
+	want := []string{
+		"/data/ 5 " + dirMode + " 1000:1000 laze:laze ",
+		"/data/a.txt 0 " + fileMode + " 1000:1000 laze:laze ",
+		"/data/sub/ 5 " + dirMode + " 1000:1000 laze:laze ",
+		"/data/sub/b.txt 0 0755 1000:1000 laze:laze ",
+		"/src/main.go 0 0600 1000:1000 laze:laze ",
+		"/tmp/ 5 0755 1000:1000 laze:laze ",
+		"/usr/bin/main 2 0777 1000:1000 laze:laze /src/main.go",
+		"/var/log/ 5 0755 1000:1000 laze:laze ",
+	}
+	got := readTar(t, "testdata/packaging/data.tar")
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func buildFile(t *testing.T, label string) []byte {
+	t.Helper()
+	b := Builder{}
+	a, err := b.Build(context.Background(), nil, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestTarFormats(t *testing.T) {
+	buildFile(t, "testdata/packaging/data.tar")
+	want := readTar(t, "testdata/packaging/data.tar")
+
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar.zst", ".tar.xz", ".zip"} {
+		t.Run(ext, func(t *testing.T) {
+			filename := "testdata/packaging/data" + ext
+			first := buildFile(t, filename)
+
+			// Rebuilds of touched sources are the same.
+			now := time.Now()
+			if err := os.Chtimes("testdata/packaging/data/a.txt", now, now); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(filename); err != nil {
+				t.Fatal(err)
+			}
+			if second := buildFile(t, filename); !bytes.Equal(first, second) {
+				t.Fatal("archive isn't reproducible")
+			}
+
+			if ext != ".zip" {
+				got := readTar(t, filename)
+				if strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+				}
+				return
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, wantZip []string
+			for _, f := range zr.File {
+				got = append(got, fmt.Sprintf("%s %s", f.Name, f.Mode()))
+			}
+			for _, line := range want {
+				// name type mode ...
+				parts := strings.Fields(line)
+				var mode os.FileMode
+				fmt.Sscanf(parts[2], "%o", &mode)
+				switch parts[1] {
+				case "5":
+					mode |= os.ModeDir
+				case "2":
+					mode |= os.ModeSymlink
+				}
+				wantZip = append(wantZip, fmt.Sprintf("%s %s", strings.TrimPrefix(parts[0], "/"), mode))
+			}
+			if strings.Join(got, "\n") != strings.Join(wantZip, "\n") {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wantZip, "\n"))
+			}
+		})
+	}
+}
+
+// readAr returns the members of an ar archive.
+func readAr(t *testing.T, data []byte) map[string][]byte {
+	t.Helper()
+	if !bytes.HasPrefix(data, []byte("!<arch>\n")) {
+		t.Fatal("missing ar header")
+	}
+	data = data[8:]
+	members := make(map[string][]byte)
+	for len(data) > 0 {
+		if len(data) < 60 {
+			t.Fatalf("short ar header %q", data)
+		}
+		name := strings.TrimSpace(string(data[:16]))
+		var size int
+		if _, err := fmt.Sscanf(string(data[48:58]), "%d", &size); err != nil {
+			t.Fatal(err)
+		}
+		data = data[60:]
+		members[name] = data[:size]
+		data = data[size+size%2:]
+	}
+	return members
+}
+
+func TestDeb(t *testing.T) {
+	first := buildFile(t, "testdata/packaging/data.deb")
+	if err := os.Remove("testdata/packaging/data.deb"); err != nil {
+		t.Fatal(err)
+	}
+	if second := buildFile(t, "testdata/packaging/data.deb"); !bytes.Equal(first, second) {
+		t.Fatal("deb isn't reproducible")
+	}
+
+	members := readAr(t, first)
+	if got := string(members["debian-binary"]); got != "2.0\n" {
+		t.Errorf("debian-binary: %q", got)
+	}
+
+	control := make(map[string]string)
+	zr, err := gzip.NewReader(bytes.NewReader(members["control.tar.gz"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		control[hdr.Name] = string(b)
+	}
+	if got, want := control["./control"], `Package: laze-data
+Version: 1.0.0
+Architecture: all
+Maintainer: Laze <laze@example.com>
+Installed-Size: 1
+Depends: libc6
+Description: Laze test data
+ Files of the laze packaging tests.
+ .
+ Not for installing.
+`; got != want {
+		t.Errorf("control:\n%s\nwant:\n%s", got, want)
+	}
+	if got, want := control["./conffiles"], "/etc/laze.conf\n"; got != want {
+		t.Errorf("conffiles: %q, want %q", got, want)
+	}
+	if got := control["./md5sums"]; !strings.Contains(got, "  etc/laze.conf\n") {
+		t.Errorf("md5sums: %q", got)
+	}
+
+	zr, err = gzip.NewReader(bytes.NewReader(members["data.tar.gz"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, line := range readTarReader(t, zr) {
+		names = append(names, strings.Fields(line)[0])
+	}
+	want := []string{
+		"./data/", "./data/a.txt", "./data/sub/", "./data/sub/b.txt",
+		"./etc/", "./etc/laze.conf",
+	}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Errorf("data: %v, want %v", names, want)
+	}
+}
+
+func TestDebErrors(t *testing.T) {
+	data := &tarBuilder{prefix: "./"}
+	if err := data.addDir("etc"); err != nil {
+		t.Fatal(err)
+	}
+	control := &debControl{pkg: "a", version: "1", description: "a"}
+	filename := t.TempDir() + "/a.deb"
+	if err := writeDeb(filename, control, []string{"/etc"}, data); err == nil {
+		t.Error("expected conffiles error")
+	}
+}
+
+func TestTarDeps(t *testing.T) {
+	fi, err := os.Stat("testdata/packaging/data/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileMode := fmt.Sprintf("%04o", fi.Mode().Perm())
+	di, err := os.Stat("testdata/packaging/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirMode := fmt.Sprintf("%04o", di.Mode().Perm())
+
+	for _, tt := range []struct {
+		conflict string
+		want     []string // changed entries of data.tar
+		wantErr  bool
+	}{{
+		conflict: "last",
+		want: []string{
+			"/data/sub/b.txt 0 " + fileMode + " 0:0 : ",
+			"/src/main.go 2 0777 42:42 : ../data/a.txt",
+		},
+	}, {
+		conflict: "first",
+		want: []string{
+			"/data/sub/b.txt 0 0755 1000:1000 laze:laze ",
+			"/src/main.go 0 0600 1000:1000 laze:laze ",
+		},
+	}, {
+		conflict: "error",
+		wantErr:  true,
+	}} {
+		t.Run(tt.conflict, func(t *testing.T) {
+			b := Builder{}
+			a, err := b.Build(context.Background(), nil, "testdata/packaging/merged.tar?conflict="+tt.conflict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.FailureErr(); err != nil {
+				if !tt.wantErr {
+					t.Fatal(err)
+				}
+				if !strings.Contains(err.Error(), "duplicate tar entry") {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if tt.wantErr {
+				t.Fatal("expected error")
+			}
+
+			want := []string{
+				"/data/ 5 " + dirMode + " 1000:1000 laze:laze ",
+				"/data/a.txt 0 " + fileMode + " 1000:1000 laze:laze ",
+				"/data/sub/ 5 " + dirMode + " 1000:1000 laze:laze ",
+				tt.want[0],
+				tt.want[1],
+				"/tmp/ 5 0755 1000:1000 laze:laze ",
+				"/usr/bin/main 2 0777 1000:1000 laze:laze /src/main.go",
+				"/var/log/ 5 0755 1000:1000 laze:laze ",
+			}
+			got := readTar(t, "testdata/packaging/merged.tar")
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestTarStripPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		stripPrefix string
+		want        string
+		wantErr     string
+	}{{
+		stripPrefix: "../go",
+		want:        "/usr/bin/hello",
+	}, {
+		stripPrefix: ".",
+		want:        "/usr/bin/hello",
+	}, {
+		stripPrefix: "/testdata",
+		want:        "/usr/bin/go/hello",
+	}, {
+		stripPrefix: "/",
+		want:        "/usr/bin/testdata/go/hello",
+	}, {
+		stripPrefix: "../cgo",
+		wantErr:     "isn't under testdata/cgo",
+	}, {
+		stripPrefix: "../g",
+		wantErr:     "isn't under testdata/g",
+	}, {
+		stripPrefix: "",
+		wantErr:     "isn't in package testdata/container",
+	}} {
+		t.Run(tt.stripPrefix, func(t *testing.T) {
+			label := "testdata/container/hello_linux.tar?strip_prefix=" + url.QueryEscape(tt.stripPrefix)
+			b := Builder{}
+			a, err := b.Build(context.Background(), nil, label)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := a.FailureErr(); err != nil {
+				if tt.wantErr == "" || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if tt.wantErr != "" {
+				t.Fatalf("expected error %q", tt.wantErr)
+			}
+
+			// The binary is configured, it's read from laze-out.
+			got := readTar(t, "testdata/container/hello_linux.tar")
+			if len(got) != 1 || !strings.HasPrefix(got[0], tt.want+" ") {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTarRemapPaths(t *testing.T) {
+	buildFile(t, "testdata/packaging/remapped.tar")
+	var got []string
+	for _, line := range readTar(t, "testdata/packaging/remapped.tar") {
+		got = append(got, strings.Fields(line)[0])
+	}
+	want := []string{"/data/", "/data/a.txt", "/opt/", "/opt/b.txt"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	tb := &tarBuilder{remaps: map[string]string{"missing": "a"}}
+	if err := tb.write(io.Discard); err == nil {
+		t.Error("expected unused remap error")
+	}
+}
+
+func TestTarErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		t    *tarBuilder
+		add  func(t *tarBuilder) error
+	}{{
+		name: "duplicate",
+		t:    &tarBuilder{},
+		add: func(t *tarBuilder) error {
+			if err := t.addSymlink("/a", "b"); err != nil {
+				return err
+			}
+			return t.addSymlink("a", "c")
+		},
+	}, {
+		name: "missingMode",
+		t:    &tarBuilder{modes: map[string]int64{"b": 0600}},
+		add: func(t *tarBuilder) error {
+			if err := t.addDir("a"); err != nil {
+				return err
+			}
+			return t.write(io.Discard)
+		},
+	}, {
+		name: "zipDevice",
+		t:    &tarBuilder{},
+		add: func(t *tarBuilder) error {
+			if err := t.add("null", &tarEntry{hdr: &tar.Header{Typeflag: tar.TypeChar}}); err != nil {
+				return err
+			}
+			return t.writeZip(io.Discard)
+		},
+	}, {
+		name: "notArchive",
+		t:    &tarBuilder{},
+		add: func(t *tarBuilder) error {
+			return t.addArchive("testdata/packaging/data/a.txt")
+		},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.add(tt.t); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
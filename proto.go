@@ -0,0 +1,384 @@
+package laze
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Providers of the proto rules.
+const (
+	// proto_info has the sources of a proto_library and its deps.
+	protoInfoConstructor starlark.String = "proto_info"
+	// protoc_plugin_info is a protoc plugin and the outputs it generates.
+	protocPluginConstructor starlark.String = "protoc_plugin_info"
+	// protoc_info has the files generated by protoc.
+	protocInfoConstructor starlark.String = "protoc_info"
+)
+
+type protoActions struct {
+	*actions
+}
+
+func newProtoModule(a *actions) *starlarkstruct.Module {
+	p := protoActions{a}
+	return &starlarkstruct.Module{
+		Name: "proto",
+		Members: starlark.StringDict{
+			"library": starlark.NewBuiltin("proto.library", p.library),
+			"plugin":  starlark.NewBuiltin("proto.plugin", p.plugin),
+			"protoc":  starlark.NewBuiltin("proto.protoc", p.protoc),
+		},
+	}
+}
+
+// targetStruct returns the provider of a target.
+func targetStruct(x starlark.Value, constructor starlark.Value) (Struct, error) {
+	t, ok := x.(*target)
+	if !ok {
+		return Struct{}, fmt.Errorf("got %s, want target", x.Type())
+	}
+	s, err := t.action.loadStructValue(constructor)
+	if err != nil {
+		return Struct{}, fmt.Errorf("%s: %w", t.label, err)
+	}
+	return s, nil
+}
+
+// AttrStrings returns the string list attr of the struct.
+func (s Struct) AttrStrings(name string) ([]string, error) {
+	x, err := s.Attr(name)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := x.(*starlark.List)
+	if !ok {
+		return nil, fmt.Errorf("attr %q not a list", name)
+	}
+	return listToStrings(l)
+}
+
+// library returns the proto_info provider of the srcs. Srcs are imported
+// relative to the import root, a path relative to the package dir. Import
+// roots of the deps are added to the -I paths of protoc.
+func (p *protoActions) library(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name       string
+		srcsList   *starlark.List
+		depsList   *starlark.List
+		importRoot string
+	)
+	if err := starlark.UnpackArgs(
+		"proto.library", args, kwargs,
+		"name", &name,
+		"srcs", &srcsList,
+		"deps?", &depsList,
+		"import_root?", &importRoot,
+	); err != nil {
+		return nil, err
+	}
+	root := path.Clean(path.Join(path.Dir(p.key), importRoot))
+
+	var srcs []string
+	for i := 0; i < srcsList.Len(); i++ {
+		t, ok := srcsList.Index(i).(*target)
+		if !ok {
+			return nil, fmt.Errorf("srcs: got %s, want target", srcsList.Index(i).Type())
+		}
+		src := t.action.Key
+		if path.Ext(src) != ".proto" {
+			return nil, fmt.Errorf("srcs: %s isn't a .proto file", t.label)
+		}
+		if root != "." && !strings.HasPrefix(src, root+"/") {
+			return nil, fmt.Errorf("srcs: %s isn't under import root %s", src, root)
+		}
+		srcs = append(srcs, src)
+	}
+
+	transitiveSrcs := append([]string(nil), srcs...)
+	roots := []string{root}
+	seen := map[string]bool{root: true}
+	if depsList != nil {
+		for i := 0; i < depsList.Len(); i++ {
+			info, err := targetStruct(depsList.Index(i), protoInfoConstructor)
+			if err != nil {
+				return nil, fmt.Errorf("deps: %w", err)
+			}
+			depSrcs, err := info.AttrStrings("transitive_srcs")
+			if err != nil {
+				return nil, err
+			}
+			transitiveSrcs = append(transitiveSrcs, depSrcs...)
+			depRoots, err := info.AttrStrings("import_roots")
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range depRoots {
+				if !seen[r] {
+					seen[r] = true
+					roots = append(roots, r)
+				}
+			}
+		}
+	}
+
+	return starlarkstruct.FromStringDict(protoInfoConstructor, starlark.StringDict{
+		"srcs":            stringsList(srcs),
+		"import_root":     starlark.String(root),
+		"transitive_srcs": stringsList(transitiveSrcs),
+		"import_roots":    stringsList(roots),
+	}), nil
+}
+
+// plugin returns the protoc_plugin_info provider of a
+// protoc-gen-<plugin_name> plugin. Outs are the files generated for each
+// proto file, "{name}" is replaced by the import path of the file without
+// ".proto".
+func (p *protoActions) plugin(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name       string
+		pluginName string
+		plugin     starlark.Value = starlark.None
+		options    *starlark.List
+		outs       *starlark.List
+	)
+	if err := starlark.UnpackArgs(
+		"proto.plugin", args, kwargs,
+		"name", &name,
+		"plugin_name", &pluginName,
+		"plugin?", &plugin,
+		"options?", &options,
+		"outs?", &outs,
+	); err != nil {
+		return nil, err
+	}
+	if pluginName == "" || strings.ContainsAny(pluginName, "=/ ") {
+		return nil, fmt.Errorf("proto.plugin: invalid plugin_name %q", pluginName)
+	}
+
+	// Plugins without a label are found on PATH by protoc.
+	var filename string
+	if plugin != starlark.None {
+		var err error
+		if filename, err = fileTarget(plugin); err != nil {
+			return nil, fmt.Errorf("plugin: %w", err)
+		}
+	}
+	if options == nil {
+		options = starlark.NewList(nil)
+	}
+	if outs == nil {
+		outs = starlark.NewList(nil)
+	}
+	if _, err := listToStrings(options); err != nil {
+		return nil, fmt.Errorf("options: %w", err)
+	}
+	if _, err := listToStrings(outs); err != nil {
+		return nil, fmt.Errorf("outs: %w", err)
+	}
+
+	return starlarkstruct.FromStringDict(protocPluginConstructor, starlark.StringDict{
+		"plugin_name": starlark.String(pluginName),
+		"path":        starlark.String(filename),
+		"options":     options,
+		"outs":        outs,
+	}), nil
+}
+
+// protocPlugin is a plugin passed to protoc.
+type protocPlugin struct {
+	name    string
+	path    string
+	options []string
+	outs    []string
+}
+
+// protoc runs protoc with the plugins on the srcs of the protos, writing to
+// the output dir of the action. It returns the protoc_info provider of the
+// declared outputs of the plugins.
+func (p *protoActions) protoc(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name        string
+		protosList  *starlark.List
+		pluginsList *starlark.List
+		protoc      starlark.Value = starlark.None
+	)
+	if err := starlark.UnpackArgs(
+		"proto.protoc", args, kwargs,
+		"name", &name,
+		"protos", &protosList,
+		"plugins", &pluginsList,
+		"protoc?", &protoc,
+	); err != nil {
+		return nil, err
+	}
+
+	protocName := "protoc"
+	if protoc != starlark.None {
+		var err error
+		if protocName, err = fileTarget(protoc); err != nil {
+			return nil, fmt.Errorf("protoc: %w", err)
+		}
+	}
+
+	// Files to generate, relative to their import root. Inputs are the
+	// workspace paths of the files and their imports.
+	var (
+		roots  []string
+		files  []string
+		inputs = make(map[string]bool)
+	)
+	seen := make(map[string]bool)
+	for i := 0; i < protosList.Len(); i++ {
+		info, err := targetStruct(protosList.Index(i), protoInfoConstructor)
+		if err != nil {
+			return nil, fmt.Errorf("protos: %w", err)
+		}
+		root, err := info.AttrString("import_root")
+		if err != nil {
+			return nil, err
+		}
+		srcs, err := info.AttrStrings("srcs")
+		if err != nil {
+			return nil, err
+		}
+		for _, src := range srcs {
+			if root != "." {
+				src = strings.TrimPrefix(src, root+"/")
+			}
+			files = append(files, src)
+		}
+		transitiveSrcs, err := info.AttrStrings("transitive_srcs")
+		if err != nil {
+			return nil, err
+		}
+		for _, src := range transitiveSrcs {
+			inputs[src] = true
+		}
+		importRoots, err := info.AttrStrings("import_roots")
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range importRoots {
+			if !seen[r] {
+				seen[r] = true
+				roots = append(roots, r)
+			}
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("proto.protoc: no proto files")
+	}
+
+	var plugins []*protocPlugin
+	for i := 0; i < pluginsList.Len(); i++ {
+		info, err := targetStruct(pluginsList.Index(i), protocPluginConstructor)
+		if err != nil {
+			return nil, fmt.Errorf("plugins: %w", err)
+		}
+		var pl protocPlugin
+		if pl.name, err = info.AttrString("plugin_name"); err != nil {
+			return nil, err
+		}
+		if pl.path, err = info.AttrString("path"); err != nil {
+			return nil, err
+		}
+		if pl.options, err = info.AttrStrings("options"); err != nil {
+			return nil, err
+		}
+		if pl.outs, err = info.AttrStrings("outs"); err != nil {
+			return nil, err
+		}
+		plugins = append(plugins, &pl)
+	}
+	if len(plugins) == 0 {
+		return nil, fmt.Errorf("proto.protoc: no plugins")
+	}
+
+	outDir := path.Dir(p.out)
+	absOut, err := filepath.Abs(filepath.FromSlash(outDir))
+	if err != nil {
+		return nil, err
+	}
+
+	var cmdArgs []string
+	for _, root := range roots {
+		abs, err := filepath.Abs(filepath.FromSlash(root))
+		if err != nil {
+			return nil, err
+		}
+		cmdArgs = append(cmdArgs, "-I"+abs)
+	}
+	var outputs []string
+	for _, pl := range plugins {
+		if pl.path != "" {
+			cmdArgs = append(cmdArgs, "--plugin=protoc-gen-"+pl.name+"="+pl.path)
+		}
+		out := absOut
+		if len(pl.options) > 0 {
+			out = strings.Join(pl.options, ",") + ":" + out
+		}
+		cmdArgs = append(cmdArgs, "--"+pl.name+"_out="+out)
+
+		for _, file := range files {
+			for _, tmpl := range pl.outs {
+				name := strings.ReplaceAll(tmpl, "{name}", strings.TrimSuffix(file, ".proto"))
+				outputs = append(outputs, path.Join(outDir, name))
+			}
+		}
+	}
+	cmdArgs = append(cmdArgs, files...)
+
+	cmd := &command{
+		Name:    protocName,
+		Args:    cmdArgs,
+		Dir:     path.Dir(p.key),
+		Outputs: outputs,
+	}
+	if p.record(cmd) {
+		elems := make([]starlark.Value, len(outputs))
+		for i, output := range outputs {
+			f, err := newPlannedFile(output)
+			if err != nil {
+				return nil, err
+			}
+			elems[i] = f
+		}
+		return newProtocInfo(elems), nil
+	}
+
+	if err := os.MkdirAll(absOut, 0777); err != nil {
+		return nil, err
+	}
+	if err := p.exec(cmd, nil); err != nil {
+		return nil, err
+	}
+	if p.action != nil {
+		p.action.inputs = sortedKeys(inputs)
+	}
+
+	elems := make([]starlark.Value, len(outputs))
+	for i, output := range outputs {
+		fi, err := os.Stat(output)
+		if err != nil {
+			return nil, fmt.Errorf("proto.protoc: declared output %s wasn't generated", output)
+		}
+		f, err := newFile(output, fi)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = f
+	}
+	return newProtocInfo(elems), nil
+}
+
+func newProtocInfo(files []starlark.Value) starlark.Value {
+	return starlarkstruct.FromStringDict(protocInfoConstructor, starlark.StringDict{
+		"files": starlark.NewList(files),
+	})
+}
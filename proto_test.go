@@ -0,0 +1,99 @@
+package laze
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+func buildStruct(t *testing.T, b *Builder, label string, constructor interface{}) *starlarkstruct.Struct {
+	t.Helper()
+	a, err := b.Build(context.Background(), nil, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+	v, ok := a.Value.(*starlarkstruct.Struct)
+	if !ok || v.Constructor() != constructor {
+		t.Fatalf("got %s, want %s", a.Value, constructor)
+	}
+	return v
+}
+
+func TestProtoLibrary(t *testing.T) {
+	info := buildStruct(t, &Builder{}, "testdata/proto/api_proto", protoInfoConstructor)
+	for name, want := range map[string][]string{
+		"srcs":            {"testdata/proto/api.proto"},
+		"transitive_srcs": {"testdata/proto/api.proto", "testdata/proto/library/book.proto"},
+		"import_roots":    {"testdata/proto", "testdata/proto/library"},
+	} {
+		if got := structStrings(t, info, name); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestProtoc(t *testing.T) {
+	generated := "testdata/proto/fake/api.pb.go"
+	if err := os.Remove(generated); err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// The fake protoc fails if the imports of the deps aren't found.
+	b := &Builder{}
+	info := buildStruct(t, b, "testdata/proto/fake/api_fake", protocInfoConstructor)
+	x, err := info.Attr("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, ok := x.(*starlark.List)
+	if !ok || files.Len() != 1 {
+		t.Fatalf("got files %v", x)
+	}
+	filename, err := Struct{files.Index(0).(*starlarkstruct.Struct)}.AttrString("path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, _ := filepath.Abs(generated); filename != want {
+		t.Errorf("got %s, want %s", filename, want)
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "package fake\n") {
+		t.Errorf("generated:\n%s", data)
+	}
+
+	// The proto files and their imports are inputs.
+	inputs := b.actionCache["file://testdata/proto/fake/api_fake"].inputs
+	if want := []string{"testdata/proto/api.proto", "testdata/proto/library/book.proto"}; !reflect.DeepEqual(inputs, want) {
+		t.Errorf("inputs: %v, want %v", inputs, want)
+	}
+
+	// Go rules compile the generated files.
+	goInfo, _ := buildGoInfo(t, &Builder{}, "testdata/proto/fake/fake_go")
+	if got, want := structStrings(t, goInfo, "files"), []string{generated}; !reflect.DeepEqual(got, want) {
+		t.Errorf("files: %v, want %v", got, want)
+	}
+}
+
+func TestProtocMissingOutput(t *testing.T) {
+	a, err := (&Builder{}).Build(context.Background(), nil, "testdata/proto/fake/api_fake_grpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "declared output testdata/proto/fake/api_grpc.pb.go wasn't generated"
+	if err := a.FailureErr(); err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("got %v, want %q", err, want)
+	}
+}
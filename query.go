@@ -0,0 +1,681 @@
+package laze
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.starlark.net/starlark"
+)
+
+// Query evaluates the expression over the action graph. Actions are
+// created but never executed. Supported expressions:
+//
+//	label                      a single target
+//	dir/...                    all targets in packages below dir
+//	deps(x [, depth])          transitive dependencies of x
+//	rdeps(universe, x [, depth]) reverse dependencies of x within universe
+//	kind(pattern, x)           targets in x with a rule kind matching pattern
+//	attr(name, pattern, x)     targets in x with attribute name matching pattern
+//	somepath(x, y)             a dependency path from x to y
+//	x + y, x union y           union
+//	x - y, x except y          difference
+//	x ^ y, x intersect y       intersection
+func (b *Builder) Query(ctx context.Context, expr string) ([]*Action, error) {
+	p := &queryParser{toks: lexQuery(expr)}
+	e, err := p.parse()
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	s, err := b.evalQuery(ctx, e)
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+
+	// Inputs are known from the last build.
+	for _, a := range s.list {
+		rec, err := b.loadRecord(a)
+		if err != nil {
+			return nil, fmt.Errorf("query: %w", err)
+		}
+		a.inputs = rec.inputNames()
+	}
+	return s.list, nil
+}
+
+// actionSet is an ordered set of actions.
+type actionSet struct {
+	list []*Action
+	seen map[*Action]bool
+}
+
+func (s *actionSet) add(a *Action) {
+	if s.seen == nil {
+		s.seen = make(map[*Action]bool)
+	}
+	if s.seen[a] {
+		return
+	}
+	s.seen[a] = true
+	s.list = append(s.list, a)
+}
+
+func (s *actionSet) has(a *Action) bool { return s.seen[a] }
+
+// Query expression nodes.
+type (
+	queryWord string
+	queryCall struct {
+		name string
+		args []queryExpr
+	}
+	queryBinary struct {
+		op   string
+		x, y queryExpr
+	}
+	queryExpr interface{}
+)
+
+// lexQuery splits the expression into words, parens and commas.
+// Words may be quoted to include special characters.
+func lexQuery(s string) []string {
+	var toks []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			toks = append(toks, string(c))
+			i++
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(s[i+1:], c)
+			if j < 0 {
+				toks = append(toks, s[i:])
+				return toks
+			}
+			toks = append(toks, s[i:i+j+2])
+			i += j + 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n\r(),", rune(s[j])) {
+				j++
+			}
+			toks = append(toks, s[i:j])
+			i = j
+		}
+	}
+	return toks
+}
+
+type queryParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *queryParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+	return ""
+}
+
+func (p *queryParser) next() string {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *queryParser) parse() (queryExpr, error) {
+	e, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q", p.peek())
+	}
+	return e, nil
+}
+
+var queryOps = map[string]string{
+	"+": "+", "union": "+",
+	"-": "-", "except": "-",
+	"^": "^", "intersect": "^",
+}
+
+func (p *queryParser) parseExpr() (queryExpr, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op, ok := queryOps[p.peek()]
+		if !ok {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		x = &queryBinary{op: op, x: x, y: y}
+	}
+}
+
+func (p *queryParser) parsePrimary() (queryExpr, error) {
+	switch tok := p.next(); tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case ")", ",":
+		return nil, fmt.Errorf("unexpected %q", tok)
+	case "(":
+		e, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if tok := p.next(); tok != ")" {
+			return nil, fmt.Errorf("expected ')', got %q", tok)
+		}
+		return e, nil
+	default:
+		if tok[0] == '"' || tok[0] == '\'' {
+			if len(tok) < 2 || tok[len(tok)-1] != tok[0] {
+				return nil, fmt.Errorf("unterminated string %s", tok)
+			}
+			return queryWord(tok[1 : len(tok)-1]), nil
+		}
+		if p.peek() != "(" {
+			return queryWord(tok), nil
+		}
+		p.next()
+
+		call := &queryCall{name: tok}
+		for {
+			arg, err := p.parseExpr()
+			if err != nil {
+				return nil, err
+			}
+			call.args = append(call.args, arg)
+
+			switch tok := p.next(); tok {
+			case ",":
+				continue
+			case ")":
+				return call, nil
+			default:
+				return nil, fmt.Errorf("expected ',' or ')', got %q", tok)
+			}
+		}
+	}
+}
+
+// word returns the literal argument i of the call.
+func (c *queryCall) word(i int) (string, error) {
+	w, ok := c.args[i].(queryWord)
+	if !ok {
+		return "", fmt.Errorf("%s: argument %d must be a word", c.name, i+1)
+	}
+	return string(w), nil
+}
+
+// depth returns the optional depth argument i of the call, -1 if unbounded.
+func (c *queryCall) depth(i int) (int, error) {
+	if len(c.args) <= i {
+		return -1, nil
+	}
+	w, err := c.word(i)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(w)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid depth %q", c.name, w)
+	}
+	return n, nil
+}
+
+func (b *Builder) evalQuery(ctx context.Context, e queryExpr) (*actionSet, error) {
+	switch e := e.(type) {
+	case queryWord:
+		return b.queryTargets(ctx, string(e))
+
+	case *queryBinary:
+		x, err := b.evalQuery(ctx, e.x)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b.evalQuery(ctx, e.y)
+		if err != nil {
+			return nil, err
+		}
+		s := &actionSet{}
+		switch e.op {
+		case "+":
+			for _, a := range x.list {
+				s.add(a)
+			}
+			for _, a := range y.list {
+				s.add(a)
+			}
+		case "-":
+			for _, a := range x.list {
+				if !y.has(a) {
+					s.add(a)
+				}
+			}
+		case "^":
+			for _, a := range x.list {
+				if y.has(a) {
+					s.add(a)
+				}
+			}
+		}
+		return s, nil
+
+	case *queryCall:
+		nargs := map[string][2]int{ // min, max
+			"deps":     {1, 2},
+			"rdeps":    {2, 3},
+			"kind":     {2, 2},
+			"attr":     {3, 3},
+			"somepath": {2, 2},
+		}
+		n, ok := nargs[e.name]
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s", e.name)
+		}
+		if len(e.args) < n[0] || len(e.args) > n[1] {
+			return nil, fmt.Errorf("%s: got %d arguments", e.name, len(e.args))
+		}
+		return b.evalQueryCall(ctx, e)
+
+	default:
+		panic(fmt.Sprintf("unhandled query expr: %T", e))
+	}
+}
+
+func (b *Builder) evalQueryCall(ctx context.Context, e *queryCall) (*actionSet, error) {
+	switch e.name {
+	case "deps":
+		x, err := b.evalQuery(ctx, e.args[0])
+		if err != nil {
+			return nil, err
+		}
+		depth, err := e.depth(1)
+		if err != nil {
+			return nil, err
+		}
+		return queryDeps(x, depth), nil
+
+	case "rdeps":
+		u, err := b.evalQuery(ctx, e.args[0])
+		if err != nil {
+			return nil, err
+		}
+		x, err := b.evalQuery(ctx, e.args[1])
+		if err != nil {
+			return nil, err
+		}
+		depth, err := e.depth(2)
+		if err != nil {
+			return nil, err
+		}
+		return queryRdeps(queryDeps(u, -1), x, depth), nil
+
+	case "kind":
+		pattern, err := e.word(0)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		x, err := b.evalQuery(ctx, e.args[1])
+		if err != nil {
+			return nil, err
+		}
+		s := &actionSet{}
+		for _, a := range x.list {
+			if re.MatchString(a.kind()) {
+				s.add(a)
+			}
+		}
+		return s, nil
+
+	case "attr":
+		name, err := e.word(0)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := e.word(1)
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		x, err := b.evalQuery(ctx, e.args[2])
+		if err != nil {
+			return nil, err
+		}
+		s := &actionSet{}
+		for _, a := range x.list {
+			v, ok := a.args[name]
+			if !ok {
+				continue
+			}
+			str, ok := starlark.AsString(v)
+			if !ok {
+				str = v.String()
+			}
+			if re.MatchString(str) {
+				s.add(a)
+			}
+		}
+		return s, nil
+
+	case "somepath":
+		x, err := b.evalQuery(ctx, e.args[0])
+		if err != nil {
+			return nil, err
+		}
+		y, err := b.evalQuery(ctx, e.args[1])
+		if err != nil {
+			return nil, err
+		}
+		return querySomepath(x, y), nil
+
+	default:
+		panic(fmt.Sprintf("unhandled query function: %s", e.name))
+	}
+}
+
+// kind returns the rule kind of the action.
+func (a *Action) kind() string {
+	if a.rule == nil {
+		return "file"
+	}
+	return a.rule.kindName()
+}
+
+// queryTargets resolves a label or a "dir/..." pattern to actions.
+func (b *Builder) queryTargets(ctx context.Context, pattern string) (*actionSet, error) {
+	s := &actionSet{}
+	if pattern != "..." && !strings.HasSuffix(pattern, "/...") {
+		u, err := parseLabel(pattern, ".")
+		if err != nil {
+			return nil, err
+		}
+		a, err := b.createAction(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		s.add(a)
+		return s, nil
+	}
+
+	root := strings.TrimSuffix(strings.TrimSuffix(pattern, "..."), "/")
+	if root == "" {
+		root = "."
+	}
+
+	var dirs []string
+	if err := filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if name != root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, filepath.ToSlash(name))
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, dir := range dirs {
+		// Broken packages are skipped so the rest of the tree can be queried.
+		if err := b.loadPackage(dir); err != nil {
+			b.Log.Warnf("skipping package %s: %v", dir, err)
+			continue
+		}
+
+		var keys []string
+		for key := range b.rulesCache {
+			if path.Dir(key) == dir {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			u, err := parseLabel(key, ".")
+			if err != nil {
+				return nil, err
+			}
+			a, err := b.createAction(ctx, u)
+			if err != nil {
+				b.Log.Warnf("skipping target %s: %v", key, err)
+				continue
+			}
+			s.add(a)
+		}
+	}
+	return s, nil
+}
+
+// queryDeps returns the transitive deps of x up to depth, -1 for all.
+func queryDeps(x *actionSet, depth int) *actionSet {
+	s := &actionSet{}
+	if depth < 0 {
+		for _, a := range x.list {
+			for _, a := range actionList(a) {
+				s.add(a)
+			}
+		}
+		return s
+	}
+
+	level := x.list
+	for _, a := range level {
+		s.add(a)
+	}
+	for i := 0; i < depth && len(level) > 0; i++ {
+		var next []*Action
+		for _, a := range level {
+			for _, a1 := range a.Deps {
+				if !s.has(a1) {
+					s.add(a1)
+					next = append(next, a1)
+				}
+			}
+		}
+		level = next
+	}
+	return s
+}
+
+// queryRdeps returns the reverse deps of x within universe up to depth.
+func queryRdeps(universe, x *actionSet, depth int) *actionSet {
+	rdeps := make(map[*Action][]*Action)
+	for _, a := range universe.list {
+		for _, a1 := range a.Deps {
+			rdeps[a1] = append(rdeps[a1], a)
+		}
+	}
+
+	s := &actionSet{}
+	var level []*Action
+	for _, a := range x.list {
+		if universe.has(a) {
+			s.add(a)
+			level = append(level, a)
+		}
+	}
+	for i := 0; i != depth && len(level) > 0; i++ {
+		var next []*Action
+		for _, a := range level {
+			for _, a1 := range rdeps[a] {
+				if !s.has(a1) {
+					s.add(a1)
+					next = append(next, a1)
+				}
+			}
+		}
+		level = next
+	}
+	return s
+}
+
+// querySomepath returns a path of deps from a node in x to a node in y.
+func querySomepath(x, y *actionSet) *actionSet {
+	seen := make(map[*Action]bool)
+	var find func(a *Action) []*Action
+	find = func(a *Action) []*Action {
+		if seen[a] {
+			return nil
+		}
+		seen[a] = true
+		if y.has(a) {
+			return []*Action{a}
+		}
+		for _, a1 := range a.Deps {
+			if p := find(a1); p != nil {
+				return append([]*Action{a}, p...)
+			}
+		}
+		return nil
+	}
+
+	s := &actionSet{}
+	for _, a := range x.list {
+		if p := find(a); p != nil {
+			for _, a := range p {
+				s.add(a)
+			}
+			break
+		}
+	}
+	return s
+}
+
+// queryTarget is the JSON output of an action.
+type queryTarget struct {
+	Label string                 `json:"label"`
+	Kind  string                 `json:"kind"`
+	Deps  []string               `json:"deps,omitempty"`
+	Attrs map[string]interface{} `json:"attrs,omitempty"`
+
+	// Inputs are the files read by the last build of the action.
+	Inputs []string `json:"inputs,omitempty"`
+}
+
+// WriteQuery writes the actions in the output format "label", "json" or
+// "dot".
+func WriteQuery(w io.Writer, format string, actions []*Action) error {
+	switch format {
+	case "label", "":
+		for _, a := range actions {
+			if _, err := fmt.Fprintln(w, a.Label); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case "json":
+		targets := make([]queryTarget, 0, len(actions))
+		for _, a := range actions {
+			t := queryTarget{
+				Label:  a.Label,
+				Kind:   a.kind(),
+				Inputs: a.inputs,
+			}
+			for _, a1 := range a.Deps {
+				t.Deps = append(t.Deps, a1.Label)
+			}
+			if len(a.args) > 0 {
+				t.Attrs = make(map[string]interface{}, len(a.args))
+				for name, v := range a.args {
+					t.Attrs[name] = toJSON(v)
+				}
+			}
+			targets = append(targets, t)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(targets)
+
+	case "dot":
+		s := &actionSet{}
+		for _, a := range actions {
+			s.add(a)
+		}
+		var buf strings.Builder
+		buf.WriteString("digraph laze {\n")
+		for _, a := range actions {
+			fmt.Fprintf(&buf, "  %q [label=%q];\n", a.Label, a.Label+"\n"+a.kind())
+		}
+		for _, a := range actions {
+			for _, a1 := range a.Deps {
+				if s.has(a1) {
+					fmt.Fprintf(&buf, "  %q -> %q;\n", a.Label, a1.Label)
+				}
+			}
+		}
+		buf.WriteString("}\n")
+		_, err := io.WriteString(w, buf.String())
+		return err
+
+	default:
+		return fmt.Errorf("unknown query output: %s", format)
+	}
+}
+
+// toJSON converts starlark values to their JSON equivalents.
+func toJSON(v starlark.Value) interface{} {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil
+	case starlark.Bool:
+		return bool(v)
+	case starlark.String:
+		return string(v)
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i
+		}
+		return v.String()
+	case starlark.Float:
+		return float64(v)
+	case starlark.Indexable:
+		l := make([]interface{}, v.Len())
+		for i := range l {
+			l[i] = toJSON(v.Index(i))
+		}
+		return l
+	case *starlark.Dict:
+		m := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := starlark.AsString(item[0])
+			if !ok {
+				k = item[0].String()
+			}
+			m[k] = toJSON(item[1])
+		}
+		return m
+	default:
+		return v.String()
+	}
+}
@@ -0,0 +1,130 @@
+package laze
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    []string
+		wantErr string
+	}{{
+		name: "label",
+		expr: "testdata/go/hello",
+		want: []string{"file://testdata/go/hello"},
+	}, {
+		name: "deps",
+		expr: "deps(testdata/packaging/helloc.tar.gz)",
+		want: []string{
+			"file://testdata/cgo/helloc?goarch=amd64&goos=linux",
+			"file://testdata/packaging/helloc.tar.gz",
+		},
+	}, {
+		name: "depsDepth",
+		expr: "deps(testdata/packaging/helloc.tar.gz, 1)",
+		want: []string{
+			"file://testdata/packaging/helloc.tar.gz",
+			"file://testdata/cgo/helloc?goarch=amd64&goos=linux",
+		},
+	}, {
+		name: "kind",
+		expr: "kind(^go$, testdata/cgo/... + testdata/go/...)",
+		want: []string{
+			"file://testdata/cgo/helloc",
+			"file://testdata/go/hello",
+		},
+	}, {
+		name: "kindFile",
+		expr: "kind(file, deps(testdata/packaging/data.tar))",
+		want: []string{
+			"file://testdata/go/main.go",
+			"file://testdata/packaging/data",
+		},
+	}, {
+		name: "attr",
+		expr: "attr(cgo, True, testdata/cgo/... + testdata/go/...)",
+		want: []string{"file://testdata/cgo/helloc"},
+	}, {
+		name: "rdeps",
+		expr: "rdeps(testdata/container/..., testdata/cgo/helloc?goarch=amd64&goos=linux)",
+		want: []string{
+			"file://testdata/cgo/helloc?goarch=amd64&goos=linux",
+			"file://testdata/packaging/helloc.tar.gz",
+			"file://testdata/container/helloc.tar",
+			"file://testdata/container/myrepo",
+		},
+	}, {
+		name: "somepath",
+		expr: "somepath(testdata/container/helloc.tar, testdata/cgo/helloc?goarch=amd64&goos=linux)",
+		want: []string{
+			"file://testdata/container/helloc.tar",
+			"file://testdata/packaging/helloc.tar.gz",
+			"file://testdata/cgo/helloc?goarch=amd64&goos=linux",
+		},
+	}, {
+		name: "except",
+		expr: "deps(testdata/go/hello) except kind(file, deps(testdata/go/hello))",
+		want: []string{"file://testdata/go/hello"},
+	}, {
+		name:    "unknownFunc",
+		expr:    "nope(testdata/go/hello)",
+		wantErr: "unknown function nope",
+	}, {
+		name:    "unbalanced",
+		expr:    "deps(testdata/go/hello",
+		wantErr: "expected ',' or ')'",
+	}}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Builder{Print: func(...interface{}) (int, error) { return 0, nil }}
+			actions, err := b.Query(context.Background(), tt.expr)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error got: %v, want: %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, a := range actions {
+				got = append(got, a.Label)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestWriteQuery(t *testing.T) {
+	b := Builder{}
+	actions, err := b.Query(context.Background(), "deps(testdata/packaging/helloc.tar.gz, 1)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WriteQuery(&buf, "dot", actions); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"file://testdata/packaging/helloc.tar.gz" -> "file://testdata/cgo/helloc?goarch=amd64&goos=linux";`) {
+		t.Fatalf("missing edge:\n%s", buf.String())
+	}
+
+	buf.Reset()
+	if err := WriteQuery(&buf, "json", actions); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"kind": "go"`) {
+		t.Fatalf("missing kind:\n%s", buf.String())
+	}
+}
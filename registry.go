@@ -0,0 +1,126 @@
+package laze
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	cname "github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// remoteRef applies the workspace registry config to a reference. It
+// returns the reference to request, rewritten to the registry's mirror if
+// mirror is set, and the remote options of its registry. Only pulls use
+// the mirror, pushes go to the registry named.
+func (b *Builder) remoteRef(ctx context.Context, ref cname.Reference, mirror bool) (cname.Reference, []remote.Option, error) {
+	keychain := authn.DefaultKeychain
+	opts := []remote.Option{
+		remote.WithContext(ctx),
+	}
+
+	var cfg *registryConfig
+	if b.workspace != nil {
+		cfg = b.workspace.registries[ref.Context().RegistryStr()]
+	}
+	if cfg == nil {
+		return ref, append(opts, remote.WithAuthFromKeychain(keychain)), nil
+	}
+
+	if (mirror && cfg.mirror != "") || cfg.insecure {
+		host := ref.Context().RegistryStr()
+		if mirror && cfg.mirror != "" {
+			host = cfg.mirror
+		}
+		sep := ":"
+		if _, ok := ref.(cname.Digest); ok {
+			sep = "@"
+		}
+		s := host + "/" + ref.Context().RepositoryStr() + sep + ref.Identifier()
+
+		var nameOpts []cname.Option
+		if cfg.insecure {
+			nameOpts = append(nameOpts, cname.Insecure)
+		}
+		mirrored, err := cname.ParseReference(s, nameOpts...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("registry %s: %w", cfg.name, err)
+		}
+		b.Log.Debugf("registry: %s is %s", ref, mirrored)
+		ref = mirrored
+	}
+
+	if cfg.insecure || cfg.caFile != "" {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: cfg.insecure,
+		}
+		if cfg.caFile != "" {
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			data, err := os.ReadFile(cfg.caFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("registry %s: %w", cfg.name, err)
+			}
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, nil, fmt.Errorf("registry %s: no certificates in %s", cfg.name, cfg.caFile)
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+		opts = append(opts, remote.WithTransport(t))
+	}
+
+	if cfg.credentialHelper != "" {
+		keychain = authn.NewMultiKeychain(
+			credentialHelper(cfg.credentialHelper), keychain,
+		)
+	}
+	return ref, append(opts, remote.WithAuthFromKeychain(keychain)), nil
+}
+
+// credentialHelper is a keychain of a docker credential helper program,
+// named docker-credential-<helper>.
+// https://github.com/docker/docker-credential-helpers
+type credentialHelper string
+
+func (h credentialHelper) Resolve(target authn.Resource) (authn.Authenticator, error) {
+	name := "docker-credential-" + string(h)
+	cmd := exec.Command(name, "get")
+	cmd.Stdin = strings.NewReader(target.RegistryStr())
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers report missing credentials on stdout.
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return authn.Anonymous, nil
+		}
+		return nil, fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	// Identity tokens are returned with the username "<token>".
+	if creds.Username == "<token>" {
+		return authn.FromConfig(authn.AuthConfig{IdentityToken: creds.Secret}), nil
+	}
+	return authn.FromConfig(authn.AuthConfig{
+		Username: creds.Username,
+		Password: creds.Secret,
+	}), nil
+}
@@ -0,0 +1,175 @@
+package laze
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// testWorkspaceBuild builds the label with the workspace config.
+func testWorkspaceBuild(t *testing.T, workspace, label string) (*Action, error) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, workspaceFile), []byte(workspace), 0666); err != nil {
+		t.Fatal(err)
+	}
+	b := Builder{Dir: dir}
+	a, err := b.Build(context.Background(), nil, label)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, a.FailureErr()
+}
+
+// testPush pushes hello to the reference with the workspace config.
+func testPush(t *testing.T, workspace, reference string) (*Action, error) {
+	t.Helper()
+	return testWorkspaceBuild(t, workspace, "testdata/container/hello_push?reference="+reference)
+}
+
+func TestRegistryMirror(t *testing.T) {
+	origin, _, _ := testRegistry(t)
+	mirror, _, _ := testRegistry(t)
+	workspace := `
+registry(
+    name = "` + origin + `",
+    mirror = "` + mirror + `",
+)
+`
+
+	// Pushes reach the origin, not the mirror.
+	a, err := testPush(t, workspace, origin+"/hello:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := a.loadStructValue(imageConstructor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := s.AttrString("reference")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := origin + "/hello@sha256:"; !strings.HasPrefix(reference, want) {
+		t.Errorf("got reference %s, want prefix %s", reference, want)
+	}
+	tag := func(s string) name.Tag {
+		t.Helper()
+		tag, err := name.NewTag(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tag
+	}
+	for _, x := range []string{"latest", "v1", "stable"} {
+		if _, err := remote.Head(tag(origin + "/hello:" + x)); err != nil {
+			t.Errorf("origin missing %s: %v", x, err)
+		}
+		if _, err := remote.Head(tag(mirror + "/hello:" + x)); err == nil {
+			t.Errorf("push of %s sent to the mirror", x)
+		}
+	}
+
+	// Pulls of the origin are sent to the mirror.
+	img, err := random.Image(1024, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := img.ConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg = cfg.DeepCopy()
+	cfg.OS, cfg.Architecture = "linux", "arm64" // platform of hello_pull.tar
+	if img, err = mutate.ConfigFile(img, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := remote.Write(tag(mirror+"/cached:latest"), img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testWorkspaceBuild(t, workspace, "testdata/container/hello_pull.tar?reference="+origin+"/cached:latest"); err != nil {
+		t.Errorf("pull from mirror: %v", err)
+	}
+}
+
+func TestRegistryTLS(t *testing.T) {
+	s := httptest.NewTLSServer(registry.New())
+	t.Cleanup(s.Close)
+	host := strings.TrimPrefix(s.URL, "https://")
+	reference := host + "/hello:latest"
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	if err := os.WriteFile(caFile, ca, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testPush(t, "", reference); err == nil {
+		t.Error("expected error with an unknown certificate authority")
+	}
+	if _, err := testPush(t, `registry(name = "`+host+`", ca_file = "`+caFile+`")`, reference); err != nil {
+		t.Errorf("ca_file: %v", err)
+	}
+	if _, err := testPush(t, `registry(name = "`+host+`", insecure = True)`, reference); err != nil {
+		t.Errorf("insecure: %v", err)
+	}
+}
+
+func TestRegistryCredentialHelper(t *testing.T) {
+	reg := registry.New()
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "laze" || pass != "secret" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	host := strings.TrimPrefix(s.URL, "http://")
+	reference := host + "/hello:latest"
+
+	// Fake docker-credential-test helper.
+	bin := t.TempDir()
+	helper := "#!/bin/sh\nread server\necho '{\"ServerURL\":\"'$server'\",\"Username\":\"laze\",\"Secret\":\"secret\"}'\n"
+	if err := os.WriteFile(filepath.Join(bin, "docker-credential-test"), []byte(helper), 0777); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if _, err := testPush(t, "", reference); err == nil {
+		t.Error("expected error without credentials")
+	}
+	if _, err := testPush(t, `registry(name = "`+host+`", credential_helper = "test")`, reference); err != nil {
+		t.Errorf("credential_helper: %v", err)
+	}
+}
+
+func TestWorkspaceErrors(t *testing.T) {
+	for _, src := range []string{
+		`registry(name = "gcr.io")
+registry(name = "gcr.io")`,
+		`registry(name = "gcr.io", mirror = "Not A Host")`,
+		`registry(name = "gcr.io", unknown = True)`,
+	} {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, workspaceFile), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		b := Builder{Dir: dir}
+		if _, err := b.loadWorkspace(); err == nil {
+			t.Errorf("expected error loading %q", src)
+		}
+	}
+}
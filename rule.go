@@ -1,15 +1,16 @@
 package laze
 
 import (
-	"bytes"
 	"context"
 	"fmt"
-	"log"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"regexp"
 	"runtime"
+	"strings"
+	"time"
 
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -33,7 +34,7 @@ func (t *target) String() string {
 }
 func (t *target) Type() string          { return "target" }
 func (t *target) Truth() starlark.Bool  { return t.action.Value.Truth() }
-func (t *target) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable") }
+func (t *target) Hash() (uint32, error) { return starlark.String(t.label).Hash() }
 func (t *target) Freeze()               {} // immutable
 
 // Attr returns the value of the specified field.
@@ -86,54 +87,104 @@ func (l *Label) Freeze() {} // immutable
 
 func ParseLabel(label string) (Label, error)*/
 
-func newCtxModule(ctx context.Context, key, dir, tmpDir string, attrs starlark.StringDict) *starlarkstruct.Module {
-	return &starlarkstruct.Module{
-		Name: "ctx",
-		Members: starlark.StringDict{
-			"actions": newActionsModule(ctx, key),
+func newCtxModule(ctx context.Context, b *Builder, action *Action, attrs starlark.StringDict) (starlark.Value, error) {
+	key := action.Key
 
-			"os":   starlark.String(runtime.GOOS),
-			"arch": starlark.String(runtime.GOARCH),
-
-			"dir":             starlark.String(dir),
-			"tmp_dir":         starlark.String(tmpDir),
-			"build_dir":       starlark.String(path.Dir(key)),
-			"build_file_path": starlark.String(path.Join(path.Dir(key), "BUILD.star")),
+	// Workspace status of stamped builds.
+	values := b.stampValues()
+	info := starlark.NewDict(len(values))
+	for _, k := range sortedStatusKeys(values) {
+		if err := info.SetKey(starlark.String(k), starlark.String(values[k])); err != nil {
+			return nil, err
+		}
+	}
+	info.Freeze()
+	// Unstamped builds have no version file.
+	var versionValue starlark.Value = starlark.None
+	if b.Stamp {
+		f, err := newPlannedFile(versionFile)
+		if err != nil {
+			return nil, err
+		}
+		versionValue = f
+	}
 
-			"key":   starlark.String(key),
-			"attrs": starlarkstruct.FromStringDict(Attrs, attrs),
+	return &ctxModule{
+		Module: &starlarkstruct.Module{
+			Name: "ctx",
+			Members: starlark.StringDict{
+				"actions": newActionsModule(ctx, b, action),
+
+				"os":   starlark.String(runtime.GOOS),
+				"arch": starlark.String(runtime.GOARCH),
+
+				"dir":             starlark.String(b.Dir),
+				"tmp_dir":         starlark.String(b.tmpDir),
+				"build_dir":       starlark.String(path.Dir(key)),
+				"out_dir":         starlark.String(action.outDir()),
+				"build_file_path": starlark.String(path.Join(path.Dir(key), "BUILD.star")),
+
+				"key":          starlark.String(key),
+				"attrs":        starlarkstruct.FromStringDict(Attrs, attrs),
+				"info":         info,
+				"version_file": versionValue,
+			},
 		},
+		action: action,
+	}, nil
+}
+
+// ctxModule is the ctx of a rule. Reading the workspace status stamps the
+// action.
+type ctxModule struct {
+	*starlarkstruct.Module
+	action *Action
+}
+
+func (c *ctxModule) Attr(name string) (starlark.Value, error) {
+	if name == "info" || name == "version_file" {
+		c.action.stamped = true
 	}
+	return c.Module.Attr(name)
 }
 
 type actions struct {
-	ctx context.Context
-	key string
+	ctx     context.Context
+	builder *Builder
+	action  *Action
+	key     string
+	out     string // output file of the action
 }
 
-func newActionsModule(ctx context.Context, key string) *starlarkstruct.Module {
-	a := &actions{ctx, key}
+func newActionsModule(ctx context.Context, b *Builder, action *Action) *starlarkstruct.Module {
+	out := path.Join(action.outDir(), path.Base(action.Key))
+	a := &actions{ctx, b, action, action.Key, out}
 	return &starlarkstruct.Module{
 		Name: "actions",
 		Members: starlark.StringDict{
 			"run":       starlark.NewBuiltin("actions.run", a.run),
+			"genrule":   starlark.NewBuiltin("actions.genrule", a.genrule),
+			"log":       newLogModule(b.Log, a.key),
 			"files":     newFilesModule(a),
 			"packaging": newPackagingModule(a),
 			"container": newContainerModule(a),
+			"go":        newGoModule(a),
+			"proto":     newProtoModule(a),
 		},
 	}
 }
 
 func (a *actions) run(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
-		name    string
-		argList *starlark.List
-		envList *starlark.List
+		name       string
+		argList    *starlark.List
+		envList    *starlark.List
+		outputList *starlark.List
 	)
 
 	if err := starlark.UnpackArgs(
 		"run", args, kwargs,
-		"name", &name, "args", &argList, "env?", &envList,
+		"name", &name, "args", &argList, "env?", &envList, "outputs?", &outputList,
 	); err != nil {
 		return nil, err
 	}
@@ -154,46 +205,141 @@ func (a *actions) run(thread *starlark.Thread, b *starlark.Builtin, args starlar
 	}
 	iter.Done()
 
-	iter = envList.Iterate()
-	for iter.Next(&x) {
-		s, ok := starlark.AsString(x)
-		if !ok {
-			return nil, fmt.Errorf("error: unexpected run env: %v", x)
+	if envList != nil {
+		iter = envList.Iterate()
+		for iter.Next(&x) {
+			s, ok := starlark.AsString(x)
+			if !ok {
+				return nil, fmt.Errorf("error: unexpected run env: %v", x)
+			}
+			cmdEnv = append(cmdEnv, s)
+		}
+		iter.Done()
+	}
+
+	var outputs []string
+	if outputList != nil {
+		var err error
+		if outputs, err = listToStrings(outputList); err != nil {
+			return nil, fmt.Errorf("error: unexpected run outputs: %w", err)
 		}
-		cmdEnv = append(cmdEnv, s)
 	}
-	iter.Done()
 
-	cmd := exec.CommandContext(a.ctx, name, cmdArgs...)
 	// TODO: set dir via args?
-	cmd.Dir = path.Dir(a.key)
-	cmd.Env = append(os.Environ(), cmdEnv...)
+	dir := path.Dir(a.key)
+	cmd := &command{
+		Name:    name,
+		Args:    cmdArgs,
+		Env:     cmdEnv,
+		Dir:     dir,
+		Outputs: outputs,
+	}
+	if a.record(cmd) {
+		return starlark.None, nil
+	}
+	if err := a.exec(cmd, nil); err != nil {
+		return nil, err
+	}
+	return starlark.None, nil
+}
 
-	var output bytes.Buffer
-	cmd.Stderr = &output
-	cmd.Stdout = &output
+// exec runs the recorded command. Output is captured in the action log,
+// stdout is written to stdout instead if set.
+func (a *actions) exec(c *command, stdout io.Writer) error {
+	cmd := exec.CommandContext(a.ctx, c.Name, c.Args...)
+	cmd.Dir = c.Dir
+	cmd.Env = append(os.Environ(), c.Env...)
+	// Children of canceled commands, like those of sh, may hold the output
+	// open. Don't wait for them.
+	cmd.WaitDelay = time.Second
+
+	// Capture combined output in the action log.
+	var output io.Writer = io.Discard
+	if a.action != nil {
+		output = &a.action.log
+	}
+	cmd.Stderr = output
+	cmd.Stdout = output
+	if stdout != nil {
+		cmd.Stdout = stdout
+	}
 
 	if err := cmd.Run(); err != nil {
-		//os.RemoveAll(tmpDir)
-		log.Printf("Unexpected error: %v\n%v", err, output.String())
-		return nil, err
+		return &runError{cmd: c, err: err}
 	}
+	return nil
+}
 
-	return starlark.None, nil
+// A command is a record of work done by an action.
+type command struct {
+	Name    string   // binary or builtin name
+	Args    []string // arguments
+	Env     []string // additional environment
+	Dir     string   // working directory
+	Outputs []string // declared outputs
+}
+
+// String returns the command line.
+func (c *command) String() string {
+	return shellQuote(append([]string{c.Name}, c.Args...)...)
+}
+
+var isShellSafe = regexp.MustCompile(`^[a-zA-Z0-9_/.,:=@%+-]+$`).MatchString
+
+// shellQuote joins args, quoting for a posix shell when needed.
+func shellQuote(args ...string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if isShellSafe(arg) {
+			quoted[i] = arg
+			continue
+		}
+		quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// record adds the command to the action. It reports whether the command
+// should be skipped as the build is a dry run.
+func (a *actions) record(cmd *command) bool {
+	if a.action != nil {
+		a.action.cmds = append(a.action.cmds, cmd)
+	}
+	return a.builder.DryRun
 }
 
 // rule a laze build rule for implementing actions.
 type rule struct {
 	builder *Builder
 	module  string
+	kind    string // exported name of the rule
+	def     *rule  // rule definition of a target, nil for definitions
 
 	impl  *starlark.Function  // implementation function
 	attrs map[string]*attr    // attribute types
 	args  starlark.StringDict // attribute args
+	test  bool                // test rules return an executable run by laze test
 
 	frozen bool
 }
 
+// isTest reports whether the rule is a test rule.
+func (r *rule) isTest() bool {
+	if r.def != nil {
+		return r.def.test
+	}
+	return r.test
+}
+
+// kindName returns the exported name of the rule definition. Rules are
+// named after the module that defines them has been loaded.
+func (r *rule) kindName() string {
+	if r.def != nil {
+		return r.def.kind
+	}
+	return r.kind
+}
+
 func (r *rule) String() string       { return "rule()" }
 func (r *rule) Type() string         { return "rule" }
 func (r *rule) Freeze()              { r.frozen = true }
@@ -204,16 +350,19 @@ func (r *rule) Hash() (uint32, error) {
 }
 
 // makeRule creates a new rule instance. Accepts the following optional kwargs:
-// "implementation", "attrs".
+// "implementation", "attrs", "test".
 //
+// Test rules have the implicit attrs "shard_count", "timeout", "flaky" and
+// "data".
 func (b *Builder) rule(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var (
 		impl  = new(starlark.Function)
 		attrs = new(starlark.Dict)
+		test  bool
 	)
 	if err := starlark.UnpackArgs(
 		"rule", args, kwargs,
-		"impl", &impl, "attrs?", &attrs,
+		"impl", &impl, "attrs?", &attrs, "test?", &test,
 	); err != nil {
 		return nil, err
 	}
@@ -241,21 +390,23 @@ func (b *Builder) rule(thread *starlark.Thread, _ *starlark.Builtin, args starla
 		doc:       "Name of rule",
 		mandatory: true,
 	}
+	if test {
+		for name, a := range testAttrs() {
+			if _, ok := m[name]; ok {
+				return nil, fmt.Errorf("%s cannot be an attribute of a test rule", name)
+			}
+			m[name] = a
+		}
+	}
 
 	return &rule{
 		builder: b,
 		impl:    impl,
 		attrs:   m, // key -> type
+		test:    test,
 	}, nil
 }
 
-// genrule(
-// 	cmd = "protoc ...",
-// 	deps = ["//:label"],
-// 	outs = ["//"],
-// 	executable = "file",
-// )
-
 var isStringAlphabetic = regexp.MustCompile(`^[a-zA-Z0-9_.]*$`).MatchString
 
 func (r *rule) Name() string { return "rule" }
@@ -271,7 +422,6 @@ func (r *rule) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs
 		name := string(kwarg[0].(starlark.String))
 		value := kwarg[1]
 		//value.Freeze()? Needed?
-		fmt.Println("\t\tname:", name)
 
 		a, ok := r.attrs[name]
 		if !ok {
@@ -289,7 +439,8 @@ func (r *rule) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs
 			// TODO: list check
 		case attrTypeLabel:
 			_, ok = value.(starlark.String)
-		//case attrTypeLabelKeyedStringDict:
+		case attrTypeLabelKeyedStringDict:
+			_, ok = value.(*starlark.Dict)
 		case attrTypeLabelList:
 			_, ok = value.(*starlark.List)
 		case attrTypeOutput:
@@ -298,7 +449,8 @@ func (r *rule) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs
 			_, ok = value.(*starlark.List)
 		case attrTypeString:
 			_, ok = value.(starlark.String)
-		//case attrTypeStringDict:
+		case attrTypeStringDict:
+			_, ok = value.(*starlark.Dict)
 		case attrTypeStringList:
 			_, ok = value.(*starlark.List)
 		//case attrTypeStringListDict:
@@ -310,7 +462,7 @@ func (r *rule) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs
 			return nil, fmt.Errorf("invalid field %s(%s): %v", name, a.typ, value)
 		}
 
-		fmt.Println("setting value", name, value)
+		r.builder.Log.Debugf("rule %s: %s = %s", r.kind, name, value)
 		attrArgs[name] = value
 		attrSeen[name] = true
 	}
@@ -324,8 +476,6 @@ func (r *rule) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs
 			attrArgs[name] = a.def
 		}
 	}
-	r.args = attrArgs
-
 	module, ok := thread.Local("module").(string)
 	if !ok {
 		return nil, fmt.Errorf("error internal: unknown module")
@@ -349,7 +499,15 @@ func (r *rule) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs
 	if r.builder.rulesCache == nil {
 		r.builder.rulesCache = make(map[string]*rule)
 	}
-	r.builder.rulesCache[key] = r
+	// Each target has its own instance of the rule args.
+	r.builder.rulesCache[key] = &rule{
+		builder: r.builder,
+		module:  module,
+		def:     r,
+		impl:    r.impl,
+		attrs:   r.attrs,
+		args:    attrArgs,
+	}
 
 	return starlark.None, nil
 }
@@ -0,0 +1,64 @@
+package laze
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	cname "github.com/google/go-containerregistry/pkg/name"
+)
+
+// RunCommand returns the command to run the result of a built action with
+// args. File targets are executed. Image targets are loaded into the docker
+// daemon as tag, or a tag named after the label if empty, and run with
+// "docker run".
+func (b *Builder) RunCommand(ctx context.Context, a *Action, tag string, args []string) (*exec.Cmd, error) {
+	if err := a.FailureErr(); err != nil {
+		return nil, err
+	}
+
+	if s, err := a.loadStructValue(fileConstructor); err == nil {
+		filename, err := s.AttrString("path")
+		if err != nil {
+			return nil, err
+		}
+		return runCmd(ctx, filename, args), nil
+	}
+
+	s, err := a.loadStructValue(imageConstructor)
+	if err != nil {
+		return nil, fmt.Errorf("%s: not runnable, want a file or image target", a.Label)
+	}
+	if tag == "" {
+		// Loaded images keep their tag.
+		tag, _ = s.AttrString("tag")
+	}
+	img, err := loadImage(newTarget(a.Label, a))
+	if err != nil {
+		return nil, err
+	}
+	var t cname.Tag
+	if tag == "" {
+		t, err = defaultTag(a.Key)
+	} else {
+		t, err = cname.NewTag(tag)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("run tag: %w", err)
+	}
+	if err := b.daemonWrite(ctx, t, img); err != nil {
+		return nil, fmt.Errorf("loading %s: %w", t, err)
+	}
+
+	dockerArgs := append([]string{"run", "--rm", "-i", t.String()}, args...)
+	return runCmd(ctx, "docker", dockerArgs), nil
+}
+
+func runCmd(ctx context.Context, name string, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
@@ -0,0 +1,31 @@
+package laze
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	b := Builder{}
+	ctx := context.Background()
+
+	a, err := b.Build(ctx, nil, "testdata/go/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := b.RunCommand(ctx, a, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(buf.String()), "Hello, go!"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+}
@@ -0,0 +1,392 @@
+package laze
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+)
+
+// SBOM formats of container_attest.
+const (
+	sbomSPDX      = "spdx"
+	sbomCycloneDX = "cyclonedx"
+)
+
+// sbomMediaTypes are the artifact media types of each SBOM format.
+var sbomMediaTypes = map[string]string{
+	sbomSPDX:      "text/spdx+json",
+	sbomCycloneDX: "application/vnd.cyclonedx+json",
+}
+
+// sbomFile is a regular file of the image filesystem.
+type sbomFile struct {
+	name    string // absolute path in the image
+	sha256  string
+	modules []sbomModule // modules of a Go binary
+}
+
+// sbomModule is a Go module of a binary in the image.
+type sbomModule struct {
+	path    string
+	version string
+}
+
+// purl is the package URL of the module.
+func (m sbomModule) purl() string {
+	return "pkg:golang/" + m.path + "@" + m.version
+}
+
+// sbom is the software bill of materials of an image.
+type sbom struct {
+	name    string // repository of the image
+	digest  string
+	created time.Time
+	files   []sbomFile
+	modules []sbomModule
+}
+
+// newSBOM lists the files and Go modules of the images' flattened
+// filesystems. Modules are read from the build info of Go binaries.
+func newSBOM(name, digest string, created time.Time, imgs ...v1.Image) (*sbom, error) {
+	files := make(map[string]sbomFile)
+	for _, img := range imgs {
+		layers, err := img.Layers()
+		if err != nil {
+			return nil, err
+		}
+		for _, layer := range layers {
+			if err := sbomLayer(layer, files); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Modules of binaries removed by later layers aren't listed.
+	s := &sbom{name: name, digest: digest, created: created}
+	modules := make(map[sbomModule]bool)
+	for _, f := range files {
+		s.files = append(s.files, f)
+		for _, m := range f.modules {
+			modules[m] = true
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	for m := range modules {
+		s.modules = append(s.modules, m)
+	}
+	sort.Slice(s.modules, func(i, j int) bool {
+		if s.modules[i].path != s.modules[j].path {
+			return s.modules[i].path < s.modules[j].path
+		}
+		return s.modules[i].version < s.modules[j].version
+	})
+	return s, nil
+}
+
+// sbomLayer adds the layer's files, replacing files of lower layers.
+// Whiteouts remove the files and directories of lower layers, and opaque
+// whiteouts the contents of their directory.
+func sbomLayer(layer v1.Layer, files map[string]sbomFile) error {
+	rc, err := layer.Uncompressed()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var (
+		added   []sbomFile
+		removed []string // files and directories
+		cleared []string // directories
+		tr      = tar.NewReader(rc)
+	)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Join("/", hdr.Name)
+		dir, base := path.Split(name)
+		if base == ".wh..wh..opq" {
+			cleared = append(cleared, path.Clean(dir))
+			continue
+		}
+		if strings.HasPrefix(base, ".wh.") {
+			removed = append(removed, path.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		f, err := readSBOMFile(name, tr)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		added = append(added, f)
+	}
+
+	// Whiteouts only apply to lower layers.
+	for name := range files {
+		for _, dir := range cleared {
+			if strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/") {
+				delete(files, name)
+			}
+		}
+		for _, x := range removed {
+			if name == x || strings.HasPrefix(name, x+"/") {
+				delete(files, name)
+			}
+		}
+	}
+	for _, f := range added {
+		files[f.name] = f
+	}
+	return nil
+}
+
+// readSBOMFile hashes the file, reading the modules of ELF and Mach-O
+// files built by Go. Other files are streamed.
+func readSBOMFile(name string, r io.Reader) (sbomFile, error) {
+	h := sha256.New()
+	var magic [4]byte
+	n, err := io.ReadFull(r, magic[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return sbomFile{}, err
+	}
+	h.Write(magic[:n])
+
+	f := sbomFile{name: name}
+	if !isExecutableMagic(magic[:n]) {
+		if _, err := io.Copy(h, r); err != nil {
+			return sbomFile{}, err
+		}
+		f.sha256 = hex.EncodeToString(h.Sum(nil))
+		return f, nil
+	}
+
+	// Build info is read from the sections of the binary.
+	buf := bytes.NewBuffer(append([]byte(nil), magic[:n]...))
+	if _, err := io.Copy(io.MultiWriter(h, buf), r); err != nil {
+		return sbomFile{}, err
+	}
+	f.sha256 = hex.EncodeToString(h.Sum(nil))
+
+	info, err := buildinfo.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return f, nil // not a Go binary
+	}
+	f.modules = append(f.modules, sbomModule{info.Main.Path, info.Main.Version})
+	for _, dep := range info.Deps {
+		if dep.Replace != nil {
+			dep = dep.Replace
+		}
+		f.modules = append(f.modules, sbomModule{dep.Path, dep.Version})
+	}
+	return f, nil
+}
+
+// isExecutableMagic reports whether the file starts with the magic number
+// of an ELF or Mach-O binary.
+func isExecutableMagic(magic []byte) bool {
+	if len(magic) < 4 {
+		return false
+	}
+	if string(magic) == "\x7fELF" {
+		return true
+	}
+	switch binary.BigEndian.Uint32(magic) {
+	case 0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe, 0xcafebabe:
+		return true
+	}
+	return false
+}
+
+// marshal encodes the SBOM as JSON in the format.
+func (s *sbom) marshal(format string) ([]byte, error) {
+	var v interface{}
+	switch format {
+	case sbomSPDX:
+		v = s.spdx()
+	case sbomCycloneDX:
+		v = s.cycloneDX()
+	default:
+		return nil, fmt.Errorf("unknown sbom format: %q", format)
+	}
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// spdx is an SPDX 2.2 JSON document.
+// https://spdx.github.io/spdx-spec/v2.2.2/
+func (s *sbom) spdx() interface{} {
+	type checksum struct {
+		Algorithm     string `json:"algorithm"`
+		ChecksumValue string `json:"checksumValue"`
+	}
+	type externalRef struct {
+		ReferenceCategory string `json:"referenceCategory"`
+		ReferenceType     string `json:"referenceType"`
+		ReferenceLocator  string `json:"referenceLocator"`
+	}
+	type pkg struct {
+		SPDXID           string        `json:"SPDXID"`
+		Name             string        `json:"name"`
+		VersionInfo      string        `json:"versionInfo,omitempty"`
+		DownloadLocation string        `json:"downloadLocation"`
+		FilesAnalyzed    bool          `json:"filesAnalyzed"`
+		ExternalRefs     []externalRef `json:"externalRefs,omitempty"`
+	}
+	type file struct {
+		SPDXID    string     `json:"SPDXID"`
+		FileName  string     `json:"fileName"`
+		Checksums []checksum `json:"checksums"`
+	}
+	type creationInfo struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	}
+	type relationship struct {
+		SPDXElementID      string `json:"spdxElementId"`
+		RelationshipType   string `json:"relationshipType"`
+		RelatedSPDXElement string `json:"relatedSpdxElement"`
+	}
+
+	const imageID = "SPDXRef-Image"
+	packages := []pkg{{
+		SPDXID:           imageID,
+		Name:             s.name,
+		VersionInfo:      s.digest,
+		DownloadLocation: "NOASSERTION",
+	}}
+	relationships := []relationship{{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: imageID,
+	}}
+	for i, m := range s.modules {
+		id := fmt.Sprintf("SPDXRef-Package-%d", i)
+		packages = append(packages, pkg{
+			SPDXID:           id,
+			Name:             m.path,
+			VersionInfo:      m.version,
+			DownloadLocation: "NOASSERTION",
+			ExternalRefs: []externalRef{{
+				ReferenceCategory: "PACKAGE_MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  m.purl(),
+			}},
+		})
+		relationships = append(relationships, relationship{imageID, "CONTAINS", id})
+	}
+	var files []file
+	for i, f := range s.files {
+		id := fmt.Sprintf("SPDXRef-File-%d", i)
+		files = append(files, file{
+			SPDXID:    id,
+			FileName:  f.name,
+			Checksums: []checksum{{"SHA256", f.sha256}},
+		})
+		relationships = append(relationships, relationship{imageID, "CONTAINS", id})
+	}
+
+	return struct {
+		SPDXVersion       string         `json:"spdxVersion"`
+		DataLicense       string         `json:"dataLicense"`
+		SPDXID            string         `json:"SPDXID"`
+		Name              string         `json:"name"`
+		DocumentNamespace string         `json:"documentNamespace"`
+		CreationInfo      creationInfo   `json:"creationInfo"`
+		Packages          []pkg          `json:"packages"`
+		Files             []file         `json:"files,omitempty"`
+		Relationships     []relationship `json:"relationships"`
+	}{
+		SPDXVersion:       "SPDX-2.2",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.name + "@" + s.digest,
+		DocumentNamespace: "https://" + s.name + "/spdx/" + s.digest,
+		CreationInfo: creationInfo{
+			Created:  s.created.UTC().Format(time.RFC3339),
+			Creators: []string{"Tool: laze"},
+		},
+		Packages:      packages,
+		Files:         files,
+		Relationships: relationships,
+	}
+}
+
+// cycloneDX is a CycloneDX 1.4 JSON BOM.
+// https://cyclonedx.org/docs/1.4/json/
+func (s *sbom) cycloneDX() interface{} {
+	type hash struct {
+		Alg     string `json:"alg"`
+		Content string `json:"content"`
+	}
+	type component struct {
+		Type    string `json:"type"`
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+		PURL    string `json:"purl,omitempty"`
+		Hashes  []hash `json:"hashes,omitempty"`
+	}
+	type tool struct {
+		Name string `json:"name"`
+	}
+
+	var components []component
+	for _, m := range s.modules {
+		components = append(components, component{
+			Type:    "library",
+			Name:    m.path,
+			Version: m.version,
+			PURL:    m.purl(),
+		})
+	}
+	for _, f := range s.files {
+		components = append(components, component{
+			Type:   "file",
+			Name:   f.name,
+			Hashes: []hash{{"SHA-256", f.sha256}},
+		})
+	}
+
+	type metadata struct {
+		Timestamp string    `json:"timestamp"`
+		Tools     []tool    `json:"tools"`
+		Component component `json:"component"`
+	}
+	return struct {
+		BOMFormat   string      `json:"bomFormat"`
+		SpecVersion string      `json:"specVersion"`
+		Version     int         `json:"version"`
+		Metadata    metadata    `json:"metadata"`
+		Components  []component `json:"components"`
+	}{
+		BOMFormat:   "CycloneDX",
+		SpecVersion: "1.4",
+		Version:     1,
+		Metadata: metadata{
+			Timestamp: s.created.UTC().Format(time.RFC3339),
+			Tools:     []tool{{"laze"}},
+			Component: component{
+				Type:    "container",
+				Name:    s.name,
+				Version: s.digest,
+			},
+		},
+		Components: components,
+	}
+}
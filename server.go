@@ -0,0 +1,313 @@
+package laze
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server keeps a Builder warm between invocations. Clients connect over a
+// unix socket and builds are run one at a time on the shared builder.
+// Starlark files are checked for changes before each build and the builder
+// is recreated if any have been modified.
+type Server struct {
+	Dir         string        // workspace directory
+	CacheDir    string        // action cache directory of builds, disabled if empty
+	LogDir      string        // directory of per-action logs, disabled if empty
+	IdleTimeout time.Duration // shutdown after idle, zero to never shutdown
+
+	mu sync.Mutex
+	b  *Builder
+}
+
+// serverRequest is sent by the client, one per connection.
+type serverRequest struct {
+	Dir      string       `json:"dir"`
+	Args     []string     `json:"args,omitempty"`
+	Label    string       `json:"label,omitempty"`
+	Options  BuildOptions `json:"options"`
+	Shutdown bool         `json:"shutdown,omitempty"`
+}
+
+// BuildOptions are the per build settings of a Builder.
+type BuildOptions struct {
+	DryRun  bool       `json:"dry_run,omitempty"`
+	Explain bool       `json:"explain,omitempty"`
+	Stamp   bool       `json:"stamp,omitempty"`
+	Output  OutputMode `json:"output,omitempty"`
+	Log     LogLevel   `json:"log,omitempty"`
+}
+
+// printWriter adapts a print func to an io.Writer.
+type printWriter func(args ...interface{}) (int, error)
+
+func (p printWriter) Write(b []byte) (int, error) { return p(string(b)) }
+
+// serverResponse is streamed back to the client as newline delimited JSON.
+type serverResponse struct {
+	Output string `json:"output,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Done   bool   `json:"done,omitempty"`
+}
+
+// ServerSocket returns the socket path of the server for the workspace dir.
+func ServerSocket(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.Sum256([]byte(dir))
+	name := "laze-" + hex.EncodeToString(h[:6]) + ".sock"
+	return filepath.Join(os.TempDir(), name), nil
+}
+
+// ListenAndServe listens on the unix socket and serves builds until idle.
+func (s *Server) ListenAndServe(ctx context.Context, socket string) error {
+	// Remove a stale socket from a previous server.
+	if err := os.Remove(socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(socket)
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections on l. It returns nil when the server has been
+// idle for IdleTimeout or a client requests a shutdown.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	defer l.Close()
+
+	dir, err := filepath.Abs(s.Dir)
+	if err != nil {
+		return err
+	}
+
+	stopped := make(chan struct{})
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			close(stopped)
+			l.Close()
+		})
+	}
+
+	var timer *time.Timer
+	if s.IdleTimeout > 0 {
+		timer = time.AfterFunc(s.IdleTimeout, stop)
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			stop()
+		case <-stopped:
+		}
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stopped:
+				return nil
+			default:
+				return err
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if shutdown := s.handle(ctx, dir, conn); shutdown {
+			stop()
+		}
+		if timer != nil {
+			timer.Reset(s.IdleTimeout)
+		}
+	}
+}
+
+// builder returns the warm builder, creating a new one if stale.
+func (s *Server) builder() *Builder {
+	if s.b == nil || s.b.stale() {
+		s.b = &Builder{
+			Dir:      s.Dir,
+			CacheDir: s.CacheDir,
+			LogDir:   s.LogDir,
+		}
+	}
+	return s.b
+}
+
+func (s *Server) handle(ctx context.Context, dir string, conn net.Conn) (shutdown bool) {
+	defer conn.Close()
+
+	var (
+		mu  sync.Mutex
+		enc = json.NewEncoder(conn)
+	)
+	send := func(resp serverResponse) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return enc.Encode(resp)
+	}
+
+	var req serverRequest
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		send(serverResponse{Error: err.Error(), Done: true})
+		return false
+	}
+
+	// Clients send one request, the build is canceled when they disconnect.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+	}()
+	if req.Shutdown {
+		send(serverResponse{Done: true})
+		return true
+	}
+	if req.Dir != dir {
+		send(serverResponse{
+			Error: fmt.Sprintf("server workspace %s, got %s", dir, req.Dir),
+			Done:  true,
+		})
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := s.builder()
+	b.Print = func(args ...interface{}) (int, error) {
+		output := fmt.Sprint(args...)
+		if err := send(serverResponse{Output: output}); err != nil {
+			return 0, err
+		}
+		return len(output), nil
+	}
+	b.DryRun = req.Options.DryRun
+	b.Explain = req.Options.Explain
+	b.Stamp = req.Options.Stamp
+	b.Output = req.Options.Output
+	b.Log = NewLogger(printWriter(b.Print), req.Options.Log)
+	defer func() { b.Print, b.Log = nil, nil }()
+
+	resp := serverResponse{Done: true}
+	a, err := b.Build(ctx, req.Args, req.Label)
+	if err == nil && b.DryRun {
+		var buf strings.Builder
+		if err = WritePlan(&buf, a); err == nil {
+			err = send(serverResponse{Output: buf.String()})
+		}
+	}
+	if err == nil {
+		err = a.FailureErr()
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	send(resp)
+	return false
+}
+
+// Client is a connection to a build server.
+type Client struct {
+	socket string
+	conn   net.Conn // connection of the next request, nil to dial
+}
+
+// DialServer connects to a server listening on socket. The connection is
+// used by the first request, later requests dial again.
+func DialServer(socket string) (*Client, error) {
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{socket: socket, conn: conn}, nil
+}
+
+func (c *Client) do(ctx context.Context, req serverRequest, w io.Writer) error {
+	// Servers handle one request per connection.
+	conn := c.conn
+	c.conn = nil
+	if conn == nil {
+		var d net.Dialer
+		var err error
+		if conn, err = d.DialContext(ctx, "unix", c.socket); err != nil {
+			return err
+		}
+	}
+	defer conn.Close()
+
+	// Closing the connection cancels the build on the server.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(conn)
+	for {
+		var resp serverResponse
+		if err := dec.Decode(&resp); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return fmt.Errorf("server closed connection")
+			}
+			return err
+		}
+		if resp.Output != "" {
+			if _, err := io.WriteString(w, resp.Output); err != nil {
+				return err
+			}
+		}
+		if resp.Done {
+			if resp.Error != "" {
+				return fmt.Errorf("%s", resp.Error)
+			}
+			return nil
+		}
+	}
+}
+
+// Build runs the build of label on the server, streaming output to w.
+func (c *Client) Build(ctx context.Context, dir string, args []string, label string, opts BuildOptions, w io.Writer) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, serverRequest{
+		Dir:     dir,
+		Args:    args,
+		Label:   label,
+		Options: opts,
+	}, w)
+}
+
+// Shutdown stops the server.
+func (c *Client) Shutdown(ctx context.Context) error {
+	return c.do(ctx, serverRequest{Shutdown: true}, io.Discard)
+}
@@ -0,0 +1,200 @@
+package laze
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeShPackage writes a BUILD.star to dir with a target running each
+// cmd with sh in dir.
+func writeShPackage(t *testing.T, dir string, cmds map[string]string) {
+	t.Helper()
+	src := `load("rule.star", "attr", "rule")
+
+def _sh_impl(ctx):
+    ctx.actions.run(name = "sh", args = ["-c", ctx.attrs.cmd])
+
+sh = rule(
+    impl = _sh_impl,
+    attrs = {"cmd": attr.string()},
+)
+`
+	var names []string
+	for name := range cmds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		src += fmt.Sprintf("\nsh(name = %q, cmd = %q)\n", name, cmds[name])
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "BUILD.star"), []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countListener counts accepted connections.
+type countListener struct {
+	net.Listener
+	n int32
+}
+
+func (l *countListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(&l.n, 1)
+	}
+	return conn, err
+}
+
+func TestServer(t *testing.T) {
+	// Builds use a temp package, touched to invalidate the server.
+	dir := t.TempDir()
+	writeShPackage(t, dir, map[string]string{"hello": "touch hello.txt"})
+	label := filepath.Join(dir, "hello")
+
+	socket := filepath.Join(t.TempDir(), "laze.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl := &countListener{Listener: l}
+
+	s := &Server{CacheDir: t.TempDir()}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(context.Background(), cl) }()
+
+	c, err := DialServer(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if err := c.Build(ctx, "", nil, label, BuildOptions{}, &buf); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	// The build uses the dialed connection.
+	if n := atomic.LoadInt32(&cl.n); n != 1 {
+		t.Errorf("got %d connections, want 1", n)
+	}
+	b := s.b
+	if b == nil {
+		t.Fatal("missing builder")
+	}
+
+	// Second build reuses the warm builder and the action cache.
+	buf.Reset()
+	if err := c.Build(ctx, "", nil, label, BuildOptions{Explain: true}, &buf); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if s.b != b {
+		t.Fatal("builder not reused")
+	}
+	if !strings.Contains(buf.String(), ": up to date") {
+		t.Errorf("explain didn't use the cache:\n%s", buf.String())
+	}
+
+	// Touching a starlark file invalidates the builder.
+	now := time.Now().Add(time.Second)
+	if err := os.Chtimes(filepath.Join(dir, "BUILD.star"), now, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Build(ctx, "", nil, label, BuildOptions{}, &buf); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if s.b == b {
+		t.Fatal("builder not invalidated")
+	}
+
+	if err := c.Build(ctx, "", nil, filepath.Join(dir, "missing"), BuildOptions{}, &buf); err == nil {
+		t.Fatal("expected error for missing label")
+	}
+
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerCancel(t *testing.T) {
+	dir := t.TempDir()
+	writeShPackage(t, dir, map[string]string{
+		"slow":  "sleep 30 && touch slow.txt",
+		"quick": "touch quick.txt",
+	})
+
+	socket := filepath.Join(t.TempDir(), "laze.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(context.Background(), l) }()
+
+	c, err := DialServer(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Canceling the client cancels the build on the server.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	var buf bytes.Buffer
+	if err := c.Build(ctx, "", nil, filepath.Join(dir, "slow"), BuildOptions{}, &buf); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	start := time.Now()
+	ctx = context.Background()
+	if err := c.Build(ctx, "", nil, filepath.Join(dir, "quick"), BuildOptions{}, &buf); err != nil {
+		t.Fatal(err, buf.String())
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("build waited %v for the canceled build", d)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "slow.txt")); !os.IsNotExist(err) {
+		t.Errorf("canceled build created output: %v", err)
+	}
+
+	if err := c.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerIdle(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "laze.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{IdleTimeout: 10 * time.Millisecond}
+	errc := make(chan error, 1)
+	go func() { errc <- s.Serve(context.Background(), l) }()
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't shutdown when idle")
+	}
+}
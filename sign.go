@@ -0,0 +1,407 @@
+package laze
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	cname "github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Signatures and SBOMs are stored as OCI artifacts tagged after the image
+// digest, following the cosign conventions:
+// https://github.com/sigstore/cosign/blob/main/specs/SIGNATURE_SPEC.md
+const (
+	signatureMediaType  = "application/vnd.dev.cosign.simplesigning.v1+json"
+	signatureAnnotation = "dev.cosignproject.cosign/signature"
+	signatureSuffix     = ".sig"
+	sbomSuffix          = ".sbom"
+)
+
+// artifactTag is the tag of an image's artifact, "repo:sha256-<hex>.sig"
+// for the signature of the image digest.
+func artifactTag(ref cname.Digest, suffix string) (cname.Tag, error) {
+	tag := strings.Replace(ref.DigestStr(), ":", "-", 1) + suffix
+	return cname.NewTag(ref.Context().String() + ":" + tag)
+}
+
+// staticLayer is an in memory layer of an artifact.
+type staticLayer struct {
+	data      []byte
+	mediaType types.MediaType
+}
+
+func (l *staticLayer) Digest() (v1.Hash, error) {
+	h, _, err := v1.SHA256(bytes.NewReader(l.data))
+	return h, err
+}
+func (l *staticLayer) DiffID() (v1.Hash, error) { return l.Digest() }
+func (l *staticLayer) Compressed() (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(l.data)), nil
+}
+func (l *staticLayer) Uncompressed() (io.ReadCloser, error) { return l.Compressed() }
+func (l *staticLayer) Size() (int64, error)                 { return int64(len(l.data)), nil }
+func (l *staticLayer) MediaType() (types.MediaType, error)  { return l.mediaType, nil }
+
+// simpleSigning is the payload signed for an image digest.
+type simpleSigning struct {
+	Critical struct {
+		Identity struct {
+			DockerReference string `json:"docker-reference"`
+		} `json:"identity"`
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+	Optional map[string]string `json:"optional"`
+}
+
+func signaturePayload(ref cname.Digest) ([]byte, error) {
+	var p simpleSigning
+	p.Critical.Identity.DockerReference = ref.Context().String()
+	p.Critical.Image.DockerManifestDigest = ref.DigestStr()
+	p.Critical.Type = "cosign container image signature"
+	return json.Marshal(p)
+}
+
+// loadSigner reads a PEM encoded ECDSA or Ed25519 private key.
+func loadSigner(filename string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", filename)
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("%s: unsupported key type %T", filename, key)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM type %q", filename, block.Type)
+	}
+}
+
+// sign signs the payload, ECDSA keys sign the SHA-256 digest.
+func sign(signer crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := signer.(ed25519.PrivateKey); ok {
+		return signer.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	h := sha256.Sum256(payload)
+	return signer.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+// verifySignature reports whether sig is the signature of payload by pub.
+func verifySignature(pub crypto.PublicKey, payload, sig []byte) bool {
+	switch pub := pub.(type) {
+	case *ecdsa.PublicKey:
+		h := sha256.Sum256(payload)
+		return ecdsa.VerifyASN1(pub, h[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(pub, payload, sig)
+	default:
+		return false
+	}
+}
+
+// imageSignatures returns the base64 signatures of the payload in the
+// signature image.
+func imageSignatures(img v1.Image, payload []byte) ([]string, error) {
+	m, err := img.Manifest()
+	if err != nil {
+		return nil, err
+	}
+	h, _, err := v1.SHA256(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	var sigs []string
+	for _, desc := range m.Layers {
+		if desc.MediaType != signatureMediaType || desc.Digest != h {
+			continue
+		}
+		if sig, ok := desc.Annotations[signatureAnnotation]; ok {
+			sigs = append(sigs, sig)
+		}
+	}
+	return sigs, nil
+}
+
+// pushedDigest is the digest reference of a container_push target.
+func pushedDigest(t *target) (cname.Digest, error) {
+	s, err := t.action.loadStructValue(imageConstructor)
+	if err != nil {
+		if s, err = t.action.loadStructValue(imageIndexConstructor); err != nil {
+			return cname.Digest{}, fmt.Errorf("image provider: %w", err)
+		}
+	}
+	reference, err := s.AttrString("reference")
+	if err != nil {
+		return cname.Digest{}, err
+	}
+	ref, err := cname.NewDigest(reference)
+	if err != nil {
+		return cname.Digest{}, fmt.Errorf("%s: want a pushed image: %w", t.label, err)
+	}
+	return ref, nil
+}
+
+// withAttrs adds the attributes to the provider struct.
+func withAttrs(v starlark.Value, attrs starlark.StringDict) starlark.Value {
+	s := v.(*starlarkstruct.Struct)
+	d := make(starlark.StringDict)
+	s.ToStringDict(d)
+	for k, v := range attrs {
+		d[k] = v
+	}
+	return starlarkstruct.FromStringDict(s.Constructor(), d)
+}
+
+func (c *container) sign(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name  string
+		image *target
+		key   *target
+	)
+	if err := starlark.UnpackArgs(
+		"container_sign", args, kwargs,
+		"name", &name,
+		"image", &image,
+		"key", &key,
+	); err != nil {
+		return nil, err
+	}
+
+	sigFile := c.out + signatureSuffix
+	if c.record(&command{
+		Name:    "container.sign",
+		Args:    []string{image.label},
+		Outputs: []string{sigFile},
+	}) {
+		return image.action.Value, nil
+	}
+
+	keyFile, err := key.action.loadStructValue(fileConstructor)
+	if err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	keyPath, err := keyFile.AttrString("path")
+	if err != nil {
+		return nil, err
+	}
+	signer, err := loadSigner(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	ref, err := pushedDigest(image)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := artifactTag(ref, signatureSuffix)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := signaturePayload(ref)
+	if err != nil {
+		return nil, err
+	}
+	rtag, opts, err := c.remote(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	// Add to the signatures of other keys, unless already signed.
+	base := mutate.MediaType(empty.Image, types.OCIManifestSchema1)
+	if img, err := remote.Image(rtag, opts...); err == nil {
+		sigs, err := imageSignatures(img, payload)
+		if err != nil {
+			return nil, err
+		}
+		for _, sig := range sigs {
+			data, err := base64.StdEncoding.DecodeString(sig)
+			if err == nil && verifySignature(signer.Public(), payload, data) {
+				c.builder.Log.Debugf("%s: %s is signed", c.key, ref)
+				return c.signed(image, tag, sigFile, sig)
+			}
+		}
+		base = img
+	}
+
+	data, err := sign(signer, payload)
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+	sig := base64.StdEncoding.EncodeToString(data)
+	img, err := mutate.Append(base, mutate.Addendum{
+		Layer:       &staticLayer{data: payload, mediaType: signatureMediaType},
+		Annotations: map[string]string{signatureAnnotation: sig},
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.builder.Log.Debugf("%s: pushing signature %s", c.key, tag)
+	if err := remote.Write(rtag, img, opts...); err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", tag, err)
+	}
+	return c.signed(image, tag, sigFile, sig)
+}
+
+// signed writes the signature file and returns the image with the
+// signature reference.
+func (c *container) signed(image *target, tag cname.Tag, sigFile, sig string) (starlark.Value, error) {
+	if err := os.MkdirAll(path.Dir(sigFile), 0777); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(sigFile, []byte(sig+"\n"), 0666); err != nil {
+		return nil, err
+	}
+	return withAttrs(image.action.Value, starlark.StringDict{
+		"signature":      starlark.String(tag.String()),
+		"signature_file": starlark.String(sigFile),
+	}), nil
+}
+
+func (c *container) attest(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var (
+		name   string
+		image  *target
+		format = sbomSPDX
+	)
+	if err := starlark.UnpackArgs(
+		"container_attest", args, kwargs,
+		"name", &name,
+		"image", &image,
+		"format?", &format,
+	); err != nil {
+		return nil, err
+	}
+	mediaType, ok := sbomMediaTypes[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown sbom format: %q", format)
+	}
+
+	sbomFile := c.out + "." + format + ".json"
+	if c.record(&command{
+		Name:    "container.attest",
+		Args:    []string{image.label, "format=" + format},
+		Outputs: []string{sbomFile},
+	}) {
+		return image.action.Value, nil
+	}
+
+	ref, err := pushedDigest(image)
+	if err != nil {
+		return nil, err
+	}
+	rref, opts, err := c.remote(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes list the contents of every platform image.
+	desc, err := remote.Get(rref, opts...)
+	if err != nil {
+		return nil, err
+	}
+	var imgs []v1.Image
+	if desc.MediaType.IsIndex() {
+		idx, err := desc.ImageIndex()
+		if err != nil {
+			return nil, err
+		}
+		m, err := idx.IndexManifest()
+		if err != nil {
+			return nil, err
+		}
+		for _, desc := range m.Manifests {
+			img, err := idx.Image(desc.Digest)
+			if err != nil {
+				return nil, err
+			}
+			imgs = append(imgs, img)
+		}
+	} else {
+		img, err := desc.Image()
+		if err != nil {
+			return nil, err
+		}
+		imgs = append(imgs, img)
+	}
+
+	created, err := creationTime("")
+	if err != nil {
+		return nil, err
+	}
+	s, err := newSBOM(ref.Context().String(), ref.DigestStr(), created, imgs...)
+	if err != nil {
+		return nil, fmt.Errorf("sbom: %w", err)
+	}
+	data, err := s.marshal(format)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(path.Dir(sbomFile), 0777); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(sbomFile, data, 0666); err != nil {
+		return nil, err
+	}
+
+	tag, err := artifactTag(ref, sbomSuffix)
+	if err != nil {
+		return nil, err
+	}
+	img, err := mutate.Append(mutate.MediaType(empty.Image, types.OCIManifestSchema1), mutate.Addendum{
+		Layer: &staticLayer{data: data, mediaType: types.MediaType(mediaType)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	rtag, opts, err := c.remote(tag)
+	if err != nil {
+		return nil, err
+	}
+	c.builder.Log.Debugf("%s: pushing sbom %s", c.key, tag)
+	if err := remote.Write(rtag, img, opts...); err != nil {
+		return nil, fmt.Errorf("pushing %s: %w", tag, err)
+	}
+	return withAttrs(image.action.Value, starlark.StringDict{
+		"sbom":      starlark.String(tag.String()),
+		"sbom_file": starlark.String(sbomFile),
+	}), nil
+}
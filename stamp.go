@@ -0,0 +1,211 @@
+package laze
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Workspace status files of stamped builds. Stamped actions depend on the
+// stable status, which is empty and not written unless stamping.
+const (
+	stableStatusFile = "laze-out/stamp/stable-status.txt"
+	versionFile      = "laze-out/stamp/version.txt"
+)
+
+// stableStatusKey reports whether changes to the status key invalidate
+// stamped actions.
+func stableStatusKey(key string) bool {
+	return strings.HasPrefix(key, "STABLE_")
+}
+
+// loadStatus computes the workspace status used to stamp outputs, like the
+// git commit, once per build and writes the status files. Without Stamp the
+// status is empty, and dry runs and unstamped builds don't write files.
+func (b *Builder) loadStatus(ctx context.Context, ws *workspace) error {
+	values := make(map[string]string)
+	if b.Stamp {
+		git := func(args ...string) string {
+			cmd := exec.CommandContext(ctx, "git", args...)
+			cmd.Dir = b.Dir
+			out, err := cmd.Output()
+			if err != nil {
+				b.Log.Debugf("stamp: git %s: %v", strings.Join(args, " "), err)
+				return ""
+			}
+			return string(bytes.TrimSpace(out))
+		}
+		if commit := git("rev-parse", "HEAD"); commit != "" {
+			values["STABLE_GIT_COMMIT"] = commit
+			dirty := "false"
+			if git("status", "--porcelain") != "" {
+				dirty = "true"
+			}
+			values["STABLE_GIT_DIRTY"] = dirty
+		}
+		if branch := git("rev-parse", "--abbrev-ref", "HEAD"); branch != "" {
+			values["STABLE_GIT_BRANCH"] = branch
+		}
+		values["BUILD_TIMESTAMP"] = strconv.FormatInt(time.Now().Unix(), 10)
+
+		if ws != nil && ws.statusCommand != "" {
+			if err := b.runStatusCommand(ctx, ws.statusCommand, values); err != nil {
+				return err
+			}
+		}
+	}
+
+	var stable, all bytes.Buffer
+	for _, key := range sortedStatusKeys(values) {
+		line := key + " " + values[key] + "\n"
+		all.WriteString(line)
+		if stableStatusKey(key) {
+			stable.WriteString(line)
+		}
+	}
+	if b.Stamp && !b.DryRun {
+		if err := writeStatusFiles(map[string][]byte{
+			stableStatusFile: stable.Bytes(),
+			versionFile:      all.Bytes(),
+		}); err != nil {
+			return err
+		}
+	}
+
+	var stableHash string
+	if stable.Len() > 0 {
+		h := sha256.Sum256(stable.Bytes())
+		stableHash = hex.EncodeToString(h[:])
+	}
+
+	b.stampMu.Lock()
+	b.stamp = values
+	b.stableStatus = stableHash
+	b.stampMu.Unlock()
+	return nil
+}
+
+// writeStatusFiles writes the status files, unchanged files keep their mod
+// time.
+func writeStatusFiles(files map[string][]byte) error {
+	for name, data := range files {
+		if old, err := ioutil.ReadFile(name); err == nil && bytes.Equal(old, data) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(name, data, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stableStatusHash is the hash of the stable status, the stableStatusFile
+// input of stamped actions. It's empty unless stamping.
+func (b *Builder) stableStatusHash() string {
+	b.stampMu.Lock()
+	defer b.stampMu.Unlock()
+	return b.stableStatus
+}
+
+// runStatusCommand adds the "KEY value" lines printed by the command to
+// values.
+func (b *Builder) runStatusCommand(ctx context.Context, command string, values map[string]string) error {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, command)
+	cmd.Dir = b.Dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("workspace status: %s: %v: %s", command, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		key, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		values[key] = value
+	}
+	return nil
+}
+
+func sortedStatusKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// stampValues returns the workspace status of the build, empty unless
+// stamping.
+func (b *Builder) stampValues() map[string]string {
+	b.stampMu.Lock()
+	defer b.stampMu.Unlock()
+	if b.stamp == nil {
+		return map[string]string{}
+	}
+	return b.stamp
+}
+
+// stampAction returns the workspace status for the action and marks it as
+// stamped, so it depends on the stable status.
+func (b *Builder) stampAction(a *Action) map[string]string {
+	if a != nil {
+		a.stamped = true
+	}
+	return b.stampValues()
+}
+
+// stampKeyPattern matches the {KEY} placeholders of status keys.
+var stampKeyPattern = regexp.MustCompile(`\{[A-Z][A-Z0-9_]*\}`)
+
+// expandStamp replaces {KEY} in s with the stamp value of KEY. Like bazel,
+// keys without a value, including all keys of unstamped builds, are
+// replaced with "". Other braces are left as is.
+func expandStamp(s string, values map[string]string) string {
+	if !strings.Contains(s, "{") {
+		return s
+	}
+	return stampKeyPattern.ReplaceAllStringFunc(s, func(key string) string {
+		return values[key[1:len(key)-1]]
+	})
+}
+
+// creationTime parses the creation time of reproducible outputs, as unix
+// seconds or RFC 3339. Empty defaults to SOURCE_DATE_EPOCH, if set, else
+// the unix epoch.
+func creationTime(s string) (time.Time, error) {
+	if s == "" {
+		s = os.Getenv("SOURCE_DATE_EPOCH")
+	}
+	if s == "" {
+		return time.Unix(0, 0).UTC(), nil
+	}
+	if sec, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(sec, 0).UTC(), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid creation time %q: want unix seconds or RFC 3339", s)
+	}
+	return t.UTC(), nil
+}
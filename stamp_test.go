@@ -0,0 +1,219 @@
+package laze
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestWorkspaceStatus(t *testing.T) {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, workspaceFile), []byte(`
+workspace_status(command = "tools/status.sh")
+`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "tools"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "tools", "status.sh"), []byte(`#!/bin/sh
+echo "STABLE_VERSION 1.2.3"
+echo "BUILD_HOST builder 7"
+`), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &Builder{Dir: dir, Stamp: true}
+	ws, err := b.loadWorkspace()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.loadStatus(context.Background(), ws); err != nil {
+		t.Fatal(err)
+	}
+	values := b.stampValues()
+	for key, want := range map[string]string{
+		"STABLE_VERSION": "1.2.3",
+		"BUILD_HOST":     "builder 7",
+	} {
+		if got := values[key]; got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if values["BUILD_TIMESTAMP"] == "" {
+		t.Error("missing BUILD_TIMESTAMP")
+	}
+
+	// Volatile values are only in the version file.
+	stable, err := ioutil.ReadFile(stableStatusFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(stable), "STABLE_VERSION 1.2.3\n"; got != want {
+		t.Errorf("stable status: got %q, want %q", got, want)
+	}
+	version, err := ioutil.ReadFile(versionFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(version), "BUILD_HOST builder 7\n") {
+		t.Errorf("version file:\n%s", version)
+	}
+
+	// Without stamping the status is empty.
+	b.Stamp = false
+	if err := b.loadStatus(context.Background(), ws); err != nil {
+		t.Fatal(err)
+	}
+	if values := b.stampValues(); len(values) != 0 {
+		t.Errorf("unstamped values: %v", values)
+	}
+}
+
+func TestStatusFiles(t *testing.T) {
+	if err := os.RemoveAll(filepath.Dir(stableStatusFile)); err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range []*Builder{
+		{},
+		{DryRun: true},
+		{Stamp: true, DryRun: true},
+	} {
+		if err := b.loadStatus(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{stableStatusFile, versionFile} {
+			if _, err := os.Stat(name); !os.IsNotExist(err) {
+				t.Errorf("stamp %v, dry run %v: %s written", b.Stamp, b.DryRun, name)
+			}
+		}
+	}
+}
+
+func TestStampInfo(t *testing.T) {
+	b := &Builder{Stamp: true}
+	a, err := b.Build(context.Background(), nil, "testdata/stamp/info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.FailureErr(); err != nil {
+		t.Fatal(err)
+	}
+	if !a.stamped {
+		t.Error("reading ctx.info didn't stamp the action")
+	}
+	data, err := ioutil.ReadFile("testdata/stamp/info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := b.stampValues()["STABLE_GIT_COMMIT"]
+	if commit == "" || !strings.Contains(string(data), "STABLE_GIT_COMMIT "+commit+"\n") {
+		t.Errorf("missing commit %q in:\n%s", commit, data)
+	}
+}
+
+func TestStampReset(t *testing.T) {
+	b := &Builder{Stamp: true}
+	a, err := b.Build(context.Background(), nil, "testdata/stamp/info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.stamped {
+		t.Fatal("reading ctx.info didn't stamp the action")
+	}
+
+	// Actions are reused between builds, like on a server. An action that
+	// no longer reads the status isn't stamped.
+	a.Func = func(*starlark.Thread) (starlark.Value, error) { return starlark.None, nil }
+	b.Do(context.Background(), a)
+	if a.stamped {
+		t.Error("stamped wasn't reset on rerun")
+	}
+}
+
+func TestStampXDefs(t *testing.T) {
+	for _, stamp := range []bool{false, true} {
+		b := &Builder{Stamp: stamp}
+		_, filename := buildGoInfo(t, b, "testdata/go/hello_stamped")
+		out, err := exec.Command(filename).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Unstamped keys expand to "".
+		name := b.stampValues()["STABLE_GIT_COMMIT"]
+		if stamp && name == "" {
+			t.Fatal("missing STABLE_GIT_COMMIT stamp")
+		}
+		if got, want := string(out), "Hello, "+name+"!\n"; got != want {
+			t.Errorf("stamp %v: got %q, want %q", stamp, got, want)
+		}
+	}
+}
+
+func TestExpandStamp(t *testing.T) {
+	values := map[string]string{"STABLE_VERSION": "1.2.3", "BUILD_HOST": "builder"}
+	for _, tt := range []struct{ in, want string }{
+		{"v{STABLE_VERSION}", "v1.2.3"},
+		{"{BUILD_HOST}-{STABLE_VERSION}", "builder-1.2.3"},
+		{"{STABLE_MISSING}", ""},
+		{"{lower} {} {", "{lower} {} {"},
+	} {
+		if got := expandStamp(tt.in, values); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	if got := expandStamp("v{STABLE_VERSION}", nil); got != "v" {
+		t.Errorf("unstamped: got %q, want %q", got, "v")
+	}
+}
+
+func TestStampInvalidation(t *testing.T) {
+	cacheDir := t.TempDir()
+	explain := func(stamp bool, label string) string {
+		t.Helper()
+		var buf strings.Builder
+		b := &Builder{
+			CacheDir: cacheDir,
+			Stamp:    stamp,
+			Explain:  true,
+			DryRun:   true,
+			Print:    func(args ...interface{}) (int, error) { return buf.WriteString(args[0].(string)) },
+		}
+		if _, err := b.Build(context.Background(), nil, label); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	for _, label := range []string{"testdata/go/hello", "testdata/go/hello_stamped"} {
+		buildGoInfo(t, &Builder{CacheDir: cacheDir}, label)
+	}
+
+	// Unstamped builds are up to date.
+	for _, label := range []string{"testdata/go/hello", "testdata/go/hello_stamped"} {
+		if got := explain(false, label); !strings.Contains(got, "file://"+label+": up to date") {
+			t.Errorf("%s: got %s", label, got)
+		}
+	}
+
+	// Stamping only invalidates stamped actions.
+	if got := explain(true, "testdata/go/hello"); !strings.Contains(got, "up to date") {
+		t.Errorf("hello: got %s", got)
+	}
+	want := "input " + stableStatusFile + " changed"
+	if got := explain(true, "testdata/go/hello_stamped"); !strings.Contains(got, want) {
+		t.Errorf("hello_stamped: got %s, want %q", got, want)
+	}
+
+	// Unstamped builds after a stamped build are invalidated, even though
+	// the status files of the stamped build remain.
+	buildGoInfo(t, &Builder{CacheDir: cacheDir, Stamp: true}, "testdata/go/hello_stamped")
+	if got := explain(false, "testdata/go/hello_stamped"); !strings.Contains(got, want) {
+		t.Errorf("unstamped hello_stamped: got %s, want %q", got, want)
+	}
+}
@@ -0,0 +1,563 @@
+package laze
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.starlark.net/starlark"
+)
+
+// Test statuses.
+const (
+	TestPassed      = "PASSED"
+	TestFailed      = "FAILED"
+	TestFlaky       = "FLAKY"
+	TestTimeout     = "TIMEOUT"
+	TestBuildFailed = "FAILED TO BUILD"
+)
+
+const (
+	defaultTestTimeout   = 5 * time.Minute
+	defaultFlakyAttempts = 3
+)
+
+// testAttrs are the implicit attrs of test rules.
+func testAttrs() map[string]*attr {
+	return map[string]*attr{
+		"shard_count": {
+			typ: attrTypeInt,
+			def: starlark.MakeInt(1),
+			doc: "Number of shards to split the test into",
+		},
+		"timeout": {
+			typ: attrTypeString,
+			def: starlark.String(""),
+			doc: "Timeout of the test as a duration like 30s",
+		},
+		"flaky": {
+			typ: attrTypeBool,
+			def: starlark.False,
+			doc: "Retry the test on failure",
+		},
+		"data": {
+			typ:        attrTypeLabelList,
+			def:        starlark.NewList(nil),
+			doc:        "Files and directories read by the test at runtime",
+			allowEmpty: true,
+			allowFiles: allowedFiles{allow: true},
+		},
+	}
+}
+
+// TestOptions configure a test run.
+type TestOptions struct {
+	Filter        string        // filter of test cases passed to each test
+	Timeout       time.Duration // timeout of tests without one, 5m if zero
+	FlakyAttempts int           // attempts of flaky tests, 3 if zero
+	NoCache       bool          // rerun tests with cached passing results
+}
+
+// TestResult is the result of a test shard.
+type TestResult struct {
+	Label    string
+	Shard    int // shard index
+	Shards   int // total shards
+	Status   string
+	Cached   bool
+	Attempts int
+	Duration time.Duration
+	LogFile  string // output of the last attempt
+	Output   []byte // captured output of the last attempt
+	Err      error  // build error
+}
+
+// Passed reports whether the test passed, possibly after retries.
+func (r *TestResult) Passed() bool {
+	return r.Status == TestPassed || r.Status == TestFlaky
+}
+
+// testRun is a test shard to run.
+type testRun struct {
+	a        *Action
+	exe      string // absolute path of the executable
+	goTest   bool   // executable is a Go test binary
+	shard    int
+	shards   int
+	timeout  time.Duration
+	attempts int
+	cacheKey string // empty if not cached
+	result   *TestResult
+}
+
+// Test builds the test targets of the pattern and runs them. The pattern
+// is a label or a "dir/..." pattern, only test rules are run. Test shards
+// run in parallel, up to BuildP at a time. Passing results are cached by
+// the record of the test's action and reused until its inputs change.
+func (b *Builder) Test(ctx context.Context, pattern string, opts TestOptions) ([]*TestResult, error) {
+	s, err := b.queryTargets(ctx, pattern)
+	if err != nil {
+		return nil, err
+	}
+	var labels []string
+	for _, a := range s.list {
+		if a.rule != nil && a.rule.isTest() {
+			labels = append(labels, a.Label)
+		} else if len(s.list) == 1 && !strings.HasSuffix(pattern, "...") {
+			return nil, fmt.Errorf("%s: not a test rule", a.Label)
+		}
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("no test targets in %s", pattern)
+	}
+
+	var (
+		results []*TestResult
+		runs    []*testRun
+	)
+	for _, label := range labels {
+		a, err := b.Build(ctx, nil, label)
+		if err != nil {
+			return nil, err
+		}
+		if err := a.FailureErr(); err != nil {
+			results = append(results, &TestResult{
+				Label:  a.Label,
+				Shards: 1,
+				Status: TestBuildFailed,
+				Err:    err,
+			})
+			continue
+		}
+		rs, err := b.testRuns(a, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rs {
+			results = append(results, r.result)
+			if r.result.Cached {
+				continue
+			}
+			runs = append(runs, r)
+		}
+	}
+
+	jobs := make(chan *testRun)
+	var wg sync.WaitGroup
+	for i := 0; i < BuildP; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range jobs {
+				b.runTest(ctx, r, opts.Filter)
+			}
+		}()
+	}
+	for _, r := range runs {
+		jobs <- r
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, r := range runs {
+		if r.cacheKey == "" || r.result.Status != TestPassed {
+			continue
+		}
+		if err := b.saveTestResult(r); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// testRuns returns the shards of the built test action.
+func (b *Builder) testRuns(a *Action, opts TestOptions) ([]*testRun, error) {
+	f, err := a.loadStructValue(fileConstructor)
+	if err != nil {
+		return nil, fmt.Errorf("%s: test rules must return an executable file: %w", a.Label, err)
+	}
+	filename, err := f.AttrString("path")
+	if err != nil {
+		return nil, err
+	}
+	exe, err := filepath.Abs(filepath.FromSlash(filename))
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Attr("go")
+	goTest := err == nil
+
+	shards := 1
+	if v, ok := a.args["shard_count"].(starlark.Int); ok {
+		n, ok := v.Int64()
+		if !ok || n < 1 {
+			return nil, fmt.Errorf("%s: invalid shard_count %s", a.Label, v)
+		}
+		shards = int(n)
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTestTimeout
+	}
+	if v, ok := a.args["timeout"].(starlark.String); ok && v != "" {
+		if timeout, err = time.ParseDuration(string(v)); err != nil {
+			return nil, fmt.Errorf("%s: timeout: %w", a.Label, err)
+		}
+	}
+	attempts := 1
+	if v, ok := a.args["flaky"].(starlark.Bool); ok && bool(v) {
+		attempts = opts.FlakyAttempts
+		if attempts <= 0 {
+			attempts = defaultFlakyAttempts
+		}
+	}
+
+	var data string
+	if a.rec != nil {
+		if data, err = testDataHash(a, goTest); err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Label, err)
+		}
+	}
+
+	runs := make([]*testRun, shards)
+	for i := range runs {
+		r := &testRun{
+			a:        a,
+			exe:      exe,
+			goTest:   goTest,
+			shard:    i,
+			shards:   shards,
+			timeout:  timeout,
+			attempts: attempts,
+			result: &TestResult{
+				Label:  a.Label,
+				Shard:  i,
+				Shards: shards,
+			},
+		}
+		if a.rec != nil {
+			h := sha256.New()
+			fmt.Fprintf(h, "%s\n%s\n%d/%d\n%s\n", a.rec.ID, data, i, shards, opts.Filter)
+			r.cacheKey = hex.EncodeToString(h.Sum(nil))
+		}
+		if r.cacheKey != "" && !opts.NoCache {
+			if ok, err := b.loadTestResult(r); err != nil {
+				return nil, err
+			} else if ok {
+				r.result.Status = TestPassed
+				r.result.Cached = true
+			}
+		}
+		runs[i] = r
+	}
+	return runs, nil
+}
+
+// testDataHash hashes the source files and directories the test depends
+// on, like its data, and the testdata dir of Go tests. Tests read them at
+// runtime, so directories are hashed by the contents of their files.
+func testDataHash(a *Action, goTest bool) (string, error) {
+	var roots []string
+	for _, dep := range a.Deps {
+		if dep.rule == nil {
+			roots = append(roots, dep.Key)
+		}
+	}
+	if goTest {
+		roots = append(roots, path.Join(path.Dir(a.Key), "testdata"))
+	}
+	sort.Strings(roots)
+
+	h := sha256.New()
+	for _, root := range roots {
+		err := filepath.Walk(filepath.FromSlash(root), func(name string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && name == filepath.FromSlash(root) {
+					return nil
+				}
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			hash, err := hashFile(name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s %s\n", filepath.ToSlash(name), hash)
+			return nil
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cachedTest is a passing result in the test cache.
+type cachedTest struct {
+	Label    string        `json:"label"`
+	Duration time.Duration `json:"duration"`
+}
+
+func (b *Builder) testCacheFile(r *testRun) string {
+	return filepath.Join(b.CacheDir, "tests", r.cacheKey+".json")
+}
+
+// loadTestResult reports whether the test has a cached passing result.
+func (b *Builder) loadTestResult(r *testRun) (bool, error) {
+	data, err := ioutil.ReadFile(b.testCacheFile(r))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var c cachedTest
+	if err := json.Unmarshal(data, &c); err != nil {
+		return false, nil // corrupt, rerun
+	}
+	r.result.Duration = c.Duration
+	return true, nil
+}
+
+func (b *Builder) saveTestResult(r *testRun) error {
+	data, err := json.Marshal(&cachedTest{
+		Label:    r.result.Label,
+		Duration: r.result.Duration,
+	})
+	if err != nil {
+		return err
+	}
+	filename := b.testCacheFile(r)
+	if err := os.MkdirAll(filepath.Dir(filename), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, data, 0666)
+}
+
+// testDir is the directory of the logs and temporary files of a shard.
+func (r *testRun) testDir() string {
+	dir := filepath.Join("laze-out", "testlogs", filepath.FromSlash(r.a.Key))
+	if r.shards > 1 {
+		dir = filepath.Join(dir, fmt.Sprintf("shard_%d_of_%d", r.shard+1, r.shards))
+	}
+	return dir
+}
+
+// runTest runs the test shard, retrying flaky tests on failure.
+func (b *Builder) runTest(ctx context.Context, r *testRun, filter string) {
+	res := r.result
+	dir := r.testDir()
+	res.LogFile = filepath.Join(dir, "test.log")
+
+	fail := func(err error) {
+		res.Status = TestFailed
+		res.Output = []byte(err.Error() + "\n")
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		fail(err)
+		return
+	}
+	tmpDir, err := filepath.Abs(filepath.Join(dir, "tmp"))
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
+		fail(err)
+		return
+	}
+
+	env := append(os.Environ(),
+		"TEST_TARGET="+r.a.Label,
+		"TEST_SHARD_INDEX="+strconv.Itoa(r.shard),
+		"TEST_TOTAL_SHARDS="+strconv.Itoa(r.shards),
+		"TEST_FILTER="+filter,
+		"TEST_TMPDIR="+tmpDir,
+	)
+	pkgDir := path.Dir(r.a.Key)
+
+	args, err := r.testArgs(ctx, pkgDir, env, filter)
+	if err != nil {
+		fail(err)
+		return
+	}
+
+	for attempt := 1; attempt <= r.attempts; attempt++ {
+		res.Attempts = attempt
+		status, err := r.attempt(ctx, pkgDir, env, args, res.LogFile)
+		if err != nil {
+			fail(err)
+			return
+		}
+		res.Status = status
+		if status == TestPassed {
+			if attempt > 1 {
+				res.Status = TestFlaky
+			}
+			break
+		}
+	}
+	res.Output, _ = ioutil.ReadFile(res.LogFile)
+	b.Log.Debugf("test %s: %s", res.Label, res.Status)
+}
+
+// attempt runs the test once, writing its output to logFile.
+func (r *testRun) attempt(ctx context.Context, dir string, env, args []string, logFile string) (string, error) {
+	f, err := os.Create(logFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, r.exe, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = f
+	cmd.Stderr = f
+
+	start := time.Now()
+	err = cmd.Run()
+	r.result.Duration = time.Since(start)
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		fmt.Fprintf(f, "\ntest timed out after %s\n", r.timeout)
+		return TestTimeout, nil
+	case err == nil:
+		return TestPassed, nil
+	}
+	if _, ok := err.(*exec.ExitError); ok {
+		return TestFailed, nil
+	}
+	return "", err
+}
+
+// testArgs returns the arguments of the executable. Executables follow the
+// TEST_* environment, Go test binaries are run verbosely with the filter as
+// -test.run and only the tests of their shard.
+func (r *testRun) testArgs(ctx context.Context, dir string, env []string, filter string) ([]string, error) {
+	if !r.goTest {
+		return nil, nil
+	}
+	args := []string{"-test.v"}
+	if r.shards == 1 {
+		if filter != "" {
+			args = append(args, "-test.run", filter)
+		}
+		return args, nil
+	}
+
+	list := filter
+	if list == "" {
+		list = "."
+	}
+	cmd := exec.CommandContext(ctx, r.exe, "-test.list", list)
+	cmd.Dir = dir
+	cmd.Env = env
+	var buf bytes.Buffer
+	cmd.Stdout = &buf
+	cmd.Stderr = &buf
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("listing tests: %v: %s", err, buf.Bytes())
+	}
+
+	var names []string
+	var i int
+	sc := bufio.NewScanner(&buf)
+	for sc.Scan() {
+		name := strings.TrimSpace(sc.Text())
+		if name == "" || strings.HasPrefix(name, "ok ") {
+			continue
+		}
+		if i%r.shards == r.shard {
+			names = append(names, regexp.QuoteMeta(name))
+		}
+		i++
+	}
+	if len(names) == 0 {
+		return append(args, "-test.run", "^$"), nil // no tests in the shard
+	}
+	return append(args, "-test.run", "^("+strings.Join(names, "|")+")$"), nil
+}
+
+// WriteTestSummary writes the output of failed tests followed by the status
+// of each test and the totals.
+func WriteTestSummary(w io.Writer, results []*TestResult) error {
+	results = append([]*TestResult(nil), results...)
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Label != results[j].Label {
+			return results[i].Label < results[j].Label
+		}
+		return results[i].Shard < results[j].Shard
+	})
+
+	var buf strings.Builder
+	for _, r := range results {
+		if r.Passed() {
+			continue
+		}
+		if r.Err != nil {
+			fmt.Fprintf(&buf, "==> %s: %v\n", r.Label, r.Err)
+			continue
+		}
+		fmt.Fprintf(&buf, "==> %s (see %s)\n", r.name(), r.LogFile)
+		buf.Write(r.Output)
+		if n := len(r.Output); n > 0 && r.Output[n-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+
+	var passed, failed, flaky, cached int
+	for _, r := range results {
+		status := r.Status
+		switch {
+		case r.Cached:
+			cached++
+			passed++
+			status += " (cached)"
+		case r.Status == TestPassed:
+			passed++
+		case r.Status == TestFlaky:
+			flaky++
+		default:
+			failed++
+		}
+		if r.Err == nil && !r.Cached {
+			status += fmt.Sprintf(" in %.1fs", r.Duration.Seconds())
+		}
+		if r.Attempts > 1 {
+			status += fmt.Sprintf(" after %d attempts", r.Attempts)
+		}
+		fmt.Fprintf(&buf, "%-48s %s\n", r.name(), status)
+	}
+	fmt.Fprintf(&buf, "\n%d passed, %d failed, %d flaky, %d cached\n", passed, failed, flaky, cached)
+	_, err := io.WriteString(w, buf.String())
+	return err
+}
+
+// name is the label of the result with its shard.
+func (r *TestResult) name() string {
+	if r.Shards > 1 {
+		return fmt.Sprintf("%s (shard %d of %d)", r.Label, r.Shard+1, r.Shards)
+	}
+	return r.Label
+}
@@ -0,0 +1,201 @@
+package laze
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testResults runs the tests of the pattern, keyed by result name.
+func testResults(t *testing.T, b *Builder, pattern string, opts TestOptions) map[string]*TestResult {
+	t.Helper()
+	results, err := b.Test(context.Background(), pattern, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]*TestResult)
+	for _, r := range results {
+		m[r.name()] = r
+	}
+	return m
+}
+
+func TestTestRules(t *testing.T) {
+	b := &Builder{CacheDir: t.TempDir()}
+	results := testResults(t, b, "testdata/test/...", TestOptions{})
+
+	for name, want := range map[string]struct {
+		status   string
+		attempts int
+		output   string
+	}{
+		"file://testdata/test/pass":                   {TestPassed, 1, "filter=\n"},
+		"file://testdata/test/fail":                   {TestFailed, 1, "broken\n"},
+		"file://testdata/test/flaky":                  {TestFlaky, 2, "second attempt\n"},
+		"file://testdata/test/slow":                   {TestTimeout, 1, "timed out after 100ms"},
+		"file://testdata/test/sharded (shard 1 of 3)": {TestPassed, 1, "shard 0 of 3\n"},
+		"file://testdata/test/sharded (shard 2 of 3)": {TestPassed, 1, "shard 1 of 3\n"},
+		"file://testdata/test/sharded (shard 3 of 3)": {TestPassed, 1, "shard 2 of 3\n"},
+	} {
+		r, ok := results[name]
+		if !ok {
+			t.Errorf("missing result %s", name)
+			continue
+		}
+		if r.Status != want.status || r.Attempts != want.attempts || r.Cached {
+			t.Errorf("%s: got %s after %d attempts (cached %v), want %s after %d", name, r.Status, r.Attempts, r.Cached, want.status, want.attempts)
+		}
+		if !strings.Contains(string(r.Output), want.output) {
+			t.Errorf("%s: output %q, want %q", name, r.Output, want.output)
+		}
+	}
+	if len(results) != 7 {
+		t.Errorf("got %d results, want 7", len(results))
+	}
+
+	var buf strings.Builder
+	if err := WriteTestSummary(&buf, mapValues(results)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"==> file://testdata/test/fail (see laze-out/testlogs/testdata/test/fail/test.log)\nbroken\n",
+		"FLAKY in ",
+		" after 2 attempts\n",
+		"4 passed, 2 failed, 1 flaky, 0 cached\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("missing %q in summary:\n%s", want, buf.String())
+		}
+	}
+
+	// Passing results are cached, flaky and failed tests rerun.
+	results = testResults(t, b, "testdata/test/...", TestOptions{})
+	for name, r := range results {
+		if want := r.Status == TestPassed; r.Cached != want {
+			t.Errorf("%s: %s cached %v, want %v", name, r.Status, r.Cached, want)
+		}
+	}
+
+	// The filter is part of the cache key.
+	r := testResults(t, b, "testdata/test/pass", TestOptions{Filter: "Foo"})["file://testdata/test/pass"]
+	if r.Cached || !strings.Contains(string(r.Output), "filter=Foo\n") {
+		t.Errorf("got cached %v, output %q", r.Cached, r.Output)
+	}
+	r = testResults(t, b, "testdata/test/pass", TestOptions{NoCache: true})["file://testdata/test/pass"]
+	if r.Cached {
+		t.Errorf("no cache: got cached result")
+	}
+}
+
+func TestTestData(t *testing.T) {
+	cacheDir := t.TempDir()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"BUILD.star": `load("testdata/test/sh_test.star", "sh_test")
+
+sh_test(
+    name = "data_test",
+    src = "data_test.sh",
+    data = ["data"],
+)
+`,
+		"data_test.sh": "#!/bin/sh\ncat data/msg.txt\n",
+		"data/msg.txt": "hello\n",
+	} {
+		name = filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	label := filepath.Join(dir, "data_test")
+
+	run := func() *TestResult {
+		t.Helper()
+		b := &Builder{CacheDir: cacheDir}
+		results, err := b.Test(context.Background(), label, TestOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Status != TestPassed {
+			t.Fatalf("got %v", results)
+		}
+		return results[0]
+	}
+	if r := run(); r.Cached {
+		t.Fatal("first run cached")
+	}
+	if r := run(); !r.Cached {
+		t.Fatal("second run not cached")
+	}
+
+	// Editing a file in a data dir reruns the test.
+	if err := ioutil.WriteFile(filepath.Join(dir, "data/msg.txt"), []byte("changed\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	r := run()
+	if r.Cached || !strings.Contains(string(r.Output), "changed\n") {
+		t.Errorf("got cached %v, output %q", r.Cached, r.Output)
+	}
+}
+
+func mapValues(m map[string]*TestResult) []*TestResult {
+	var results []*TestResult
+	for _, r := range m {
+		results = append(results, r)
+	}
+	return results
+}
+
+func TestTestErrors(t *testing.T) {
+	b := &Builder{}
+	for pattern, want := range map[string]string{
+		"testdata/go/greet/greet": "not a test rule",
+		"testdata/packaging/...":  "no test targets",
+	} {
+		_, err := b.Test(context.Background(), pattern, TestOptions{})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", pattern, err, want)
+		}
+	}
+}
+
+func TestGoTestRun(t *testing.T) {
+	b := &Builder{}
+	results := testResults(t, b, "testdata/go/greet/...", TestOptions{})
+
+	r := results["file://testdata/go/greet/greet_test"]
+	if r.Status != TestPassed {
+		t.Fatalf("got %s: %s", r.Status, r.Output)
+	}
+	for _, want := range []string{"--- PASS: TestHello ", "--- PASS: TestHelloEmpty "} {
+		if !strings.Contains(string(r.Output), want) {
+			t.Errorf("missing %q in output:\n%s", want, r.Output)
+		}
+	}
+
+	// Each shard runs half of the tests.
+	for name, want := range map[string]string{
+		"file://testdata/go/greet/greet_sharded_test (shard 1 of 2)": "TestHello ",
+		"file://testdata/go/greet/greet_sharded_test (shard 2 of 2)": "TestHelloEmpty ",
+	} {
+		r := results[name]
+		if r == nil || r.Status != TestPassed {
+			t.Fatalf("%s: got %v", name, r)
+		}
+		if got := strings.Count(string(r.Output), "--- PASS"); got != 1 || !strings.Contains(string(r.Output), want) {
+			t.Errorf("%s: want only %q in output:\n%s", name, want, r.Output)
+		}
+	}
+
+	// The filter is passed as -test.run.
+	r = testResults(t, b, "testdata/go/greet/greet_test", TestOptions{Filter: "Empty"})["file://testdata/go/greet/greet_test"]
+	if strings.Contains(string(r.Output), "TestHello ") || !strings.Contains(string(r.Output), "TestHelloEmpty") {
+		t.Errorf("filtered output:\n%s", r.Output)
+	}
+}
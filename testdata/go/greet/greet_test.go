@@ -0,0 +1,15 @@
+package greet
+
+import "testing"
+
+func TestHello(t *testing.T) {
+	if got, want := Hello("go"), "Hello, go!"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHelloEmpty(t *testing.T) {
+	if got, want := Hello(""), "Hello, !"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+
+	"github.com/emcfarlane/laze/testdata/go/greet"
 )
 
+// name is set with ldflags by hello_x.
+var name = "go"
+
 func main() {
-	fmt.Println("Hello, go!")
+	fmt.Println(greet.Hello(name))
 }
@@ -0,0 +1,52 @@
+#!/bin/sh
+# A fake protoc: checks the files and their imports are found on the -I
+# paths, then runs each plugin with FAKE_OUT and FAKE_PARAMS set.
+set -e
+
+includes=""
+plugins=""
+outs=""
+files=""
+for arg in "$@"; do
+	case "$arg" in
+	-I*) includes="$includes ${arg#-I}" ;;
+	--plugin=protoc-gen-*) plugins="$plugins ${arg#--plugin=protoc-gen-}" ;;
+	--*_out=*) outs="$outs ${arg#--}" ;;
+	-*) echo "fake_protoc: unknown flag $arg" >&2; exit 1 ;;
+	*) files="$files $arg" ;;
+	esac
+done
+
+find_file() {
+	for inc in $includes; do
+		if [ -f "$inc/$1" ]; then
+			echo "$inc/$1"
+			return
+		fi
+	done
+	echo "fake_protoc: $1: file not found" >&2
+	exit 1
+}
+
+for f in $files; do
+	src=$(find_file "$f")
+	for imp in $(sed -n 's/^import "\(.*\)";$/\1/p' "$src"); do
+		find_file "$imp" >/dev/null
+	done
+done
+
+for out in $outs; do
+	name=${out%%_out=*}
+	dir=${out#*_out=}
+	params=""
+	case "$dir" in
+	*:*) params=${dir%%:*}; dir=${dir#*:} ;;
+	esac
+	plugin="protoc-gen-$name"
+	for p in $plugins; do
+		if [ "${p%%=*}" = "$name" ]; then
+			plugin=${p#*=}
+		fi
+	done
+	FAKE_OUT="$dir" FAKE_PARAMS="$params" "$plugin" $files
+done
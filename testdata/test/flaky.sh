@@ -0,0 +1,7 @@
+#!/bin/sh
+if [ ! -f "$TEST_TMPDIR/attempted" ]; then
+	touch "$TEST_TMPDIR/attempted"
+	echo "first attempt"
+	exit 1
+fi
+echo "second attempt"
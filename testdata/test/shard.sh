@@ -0,0 +1,2 @@
+#!/bin/sh
+echo "shard $TEST_SHARD_INDEX of $TEST_TOTAL_SHARDS"
@@ -0,0 +1,159 @@
+package laze
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// goToolchainConstructor is the go_toolchain provider, the C toolchain of a
+// Go configuration.
+const goToolchainConstructor starlark.String = "go_toolchain"
+
+// zigOS maps GOOS to the OS and ABI of zig targets.
+var zigOS = map[string]string{
+	"linux":   "linux-gnu",
+	"darwin":  "macos-none",
+	"windows": "windows-gnu",
+}
+
+// zigArch maps GOARCH to the arch of zig targets.
+var zigArch = map[string]string{
+	"386":      "x86",
+	"amd64":    "x86_64",
+	"arm":      "arm",
+	"arm64":    "aarch64",
+	"mips":     "mips",
+	"mipsle":   "mipsel",
+	"mips64":   "mips64",
+	"mips64le": "mips64el",
+	"ppc64":    "powerpc64",
+	"ppc64le":  "powerpc64le",
+	"riscv64":  "riscv64",
+	"s390x":    "s390x",
+}
+
+// zigTarget returns the zig target triple of the Go platform, like
+// x86_64-linux-gnu.
+func zigTarget(goos, goarch string) (string, error) {
+	sys, ok := zigOS[goos]
+	if !ok {
+		return "", fmt.Errorf("cgo: unsupported goos %q", goos)
+	}
+	arch, ok := zigArch[goarch]
+	if !ok {
+		return "", fmt.Errorf("cgo: unsupported goarch %q", goarch)
+	}
+	if goarch == "arm" && goos == "linux" {
+		sys = "linux-gnueabihf"
+	}
+	if goos == "darwin" && goarch != "amd64" && goarch != "arm64" {
+		return "", fmt.Errorf("cgo: unsupported platform %s/%s", goos, goarch)
+	}
+	return arch + "-" + sys, nil
+}
+
+// zigToolchain compiles C and C++ for a target with zig.
+type zigToolchain struct {
+	goos     string
+	goarch   string
+	target   string // zig target triple
+	zig      string // path of zig
+	cacheDir string // zig cache directory
+}
+
+// goToolchain returns the toolchain of the configuration, empty goos and
+// goarch are the host. In dry runs zig doesn't need to be installed.
+func (b *Builder) goToolchain(goos, goarch string) (*zigToolchain, error) {
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	target, err := zigTarget(goos, goarch)
+	if err != nil {
+		return nil, err
+	}
+
+	zig, err := exec.LookPath("zig")
+	if err != nil {
+		if !b.DryRun {
+			return nil, fmt.Errorf("cgo: zig is needed to build for %s: %w", target, err)
+		}
+		zig = "zig"
+	}
+
+	// Zig caches are shared between builds, under the action cache if set.
+	cacheDir := filepath.Join("laze-out", "zig-cache")
+	if b.CacheDir != "" {
+		cacheDir = filepath.Join(b.CacheDir, "zig")
+	}
+	if cacheDir, err = filepath.Abs(cacheDir); err != nil {
+		return nil, err
+	}
+	return &zigToolchain{
+		goos:     goos,
+		goarch:   goarch,
+		target:   target,
+		zig:      zig,
+		cacheDir: cacheDir,
+	}, nil
+}
+
+func (t *zigToolchain) cc() string  { return t.compiler("cc") }
+func (t *zigToolchain) cxx() string { return t.compiler("c++") }
+
+// compiler is the command line of the zig compiler, Go splits CC and CXX
+// into fields.
+func (t *zigToolchain) compiler(name string) string {
+	zig := t.zig
+	if strings.ContainsAny(zig, " \t'\"") {
+		zig = "'" + zig + "'"
+	}
+	return zig + " " + name + " -target " + t.target
+}
+
+// env returns the environment of go builds with cgo.
+func (t *zigToolchain) env() []string {
+	return []string{
+		"CC=" + t.cc(),
+		"CXX=" + t.cxx(),
+		"ZIG_LOCAL_CACHE_DIR=" + t.cacheDir,
+		"ZIG_GLOBAL_CACHE_DIR=" + t.cacheDir,
+	}
+}
+
+// value returns the go_toolchain provider of the toolchain.
+func (t *zigToolchain) value() starlark.Value {
+	return starlarkstruct.FromStringDict(goToolchainConstructor, starlark.StringDict{
+		"goos":       starlark.String(t.goos),
+		"goarch":     starlark.String(t.goarch),
+		"zig_target": starlark.String(t.target),
+		"cc":         starlark.String(t.cc()),
+		"cxx":        starlark.String(t.cxx()),
+		"env":        stringsList(t.env()),
+	})
+}
+
+// toolchain returns the go_toolchain provider of the configuration.
+func (g *goActions) toolchain(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var goos, goarch string
+	if err := starlark.UnpackArgs(
+		"go.toolchain", args, kwargs,
+		"goos?", &goos,
+		"goarch?", &goarch,
+	); err != nil {
+		return nil, err
+	}
+	t, err := g.builder.goToolchain(goos, goarch)
+	if err != nil {
+		return nil, err
+	}
+	return t.value(), nil
+}
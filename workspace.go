@@ -0,0 +1,138 @@
+package laze
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cname "github.com/google/go-containerregistry/pkg/name"
+	"go.starlark.net/starlark"
+)
+
+// workspaceFile configures the workspace, it's loaded from the workspace
+// directory if it exists.
+const workspaceFile = "WORKSPACE.star"
+
+// workspace is the configuration of a workspace.
+type workspace struct {
+	registries    map[string]*registryConfig // by registry host
+	statusCommand string                     // prints the workspace status of stamped builds
+}
+
+// registryConfig are the settings of requests to a registry.
+type registryConfig struct {
+	name             string // registry host
+	mirror           string // registry host requests are sent to instead
+	insecure         bool   // allow HTTP and unverified TLS
+	credentialHelper string // docker-credential-<helper> for credentials
+	caFile           string // PEM certificates of TLS roots
+}
+
+// loadWorkspace evaluates the workspace file of the builder's directory.
+func (b *Builder) loadWorkspace() (*workspace, error) {
+	ws := &workspace{
+		registries: make(map[string]*registryConfig),
+	}
+	filename := filepath.Join(b.Dir, workspaceFile)
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ws, nil
+		}
+		return nil, err
+	}
+
+	predeclared := starlark.StringDict{
+		"registry":         starlark.NewBuiltin("registry", ws.registry(b.Dir)),
+		"workspace_status": starlark.NewBuiltin("workspace_status", ws.workspaceStatus(b.Dir)),
+	}
+	for k, v := range globals {
+		predeclared[k] = v
+	}
+	thread := &starlark.Thread{Name: filename}
+	if _, err := starlark.ExecFile(thread, filename, src, predeclared); err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
+
+// registry returns the builtin that configures a registry:
+//
+//	registry(
+//	    name = "gcr.io",
+//	    mirror = "cache.internal:5000",
+//	    insecure = False,
+//	    credential_helper = "gcloud",
+//	    ca_file = "certs/ca.pem",
+//	)
+//
+// Relative CA files are in dir.
+func (ws *workspace) registry(dir string) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var cfg registryConfig
+		if err := starlark.UnpackArgs(
+			b.Name(), args, kwargs,
+			"name", &cfg.name,
+			"mirror?", &cfg.mirror,
+			"insecure?", &cfg.insecure,
+			"credential_helper?", &cfg.credentialHelper,
+			"ca_file?", &cfg.caFile,
+		); err != nil {
+			return nil, err
+		}
+
+		// Normalize names, "docker.io" is "index.docker.io".
+		reg, err := cname.NewRegistry(cfg.name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", b.Name(), err)
+		}
+		cfg.name = reg.RegistryStr()
+		if cfg.mirror != "" {
+			if _, err := cname.NewRegistry(cfg.mirror); err != nil {
+				return nil, fmt.Errorf("%s: mirror: %w", b.Name(), err)
+			}
+		}
+		if cfg.caFile != "" && !filepath.IsAbs(cfg.caFile) {
+			cfg.caFile = filepath.Join(dir, cfg.caFile)
+		}
+
+		if _, ok := ws.registries[cfg.name]; ok {
+			return nil, fmt.Errorf("%s: duplicate registry %q", b.Name(), cfg.name)
+		}
+		ws.registries[cfg.name] = &cfg
+		return starlark.None, nil
+	}
+}
+
+// workspaceStatus returns the builtin that sets the status command of
+// stamped builds:
+//
+//	workspace_status(
+//	    command = "tools/status.sh",
+//	)
+//
+// Relative commands are in dir.
+func (ws *workspace) workspaceStatus(dir string) func(*starlark.Thread, *starlark.Builtin, starlark.Tuple, []starlark.Tuple) (starlark.Value, error) {
+	return func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var command string
+		if err := starlark.UnpackArgs(
+			b.Name(), args, kwargs,
+			"command", &command,
+		); err != nil {
+			return nil, err
+		}
+		if command == "" {
+			return nil, fmt.Errorf("%s: empty command", b.Name())
+		}
+		if ws.statusCommand != "" {
+			return nil, fmt.Errorf("%s: already set", b.Name())
+		}
+		if !filepath.IsAbs(command) && strings.ContainsRune(command, '/') {
+			command = filepath.Join(dir, command)
+		}
+		ws.statusCommand = command
+		return starlark.None, nil
+	}
+}